@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of Google login
+const (
+	// An OAuth token, from the device or authorization code flow
+	tokenOAuth = "oauth"
+	// A token given for an app-specific password
+	tokenAppPassword = "app_password"
+)
+
+// Tokens are refreshed this long before they expire
+const tokenExpiryMargin = time.Minute
+
+// How much longer to wait between device login polls each time Google asks
+// us to slow down
+var deviceSlowDown = 5 * time.Second
+
+// Where the Google login flows send their requests. Every URL can be changed
+// to run the flows against a local stub.
+type AuthEndpoints struct {
+	DeviceCodeURL  string
+	AuthorizeURL   string
+	TokenURL       string
+	AppPasswordURL string
+	ClientID       string
+	ClientSecret   string
+	Scope          string
+}
+
+var defaultAuthEndpoints = AuthEndpoints{
+	DeviceCodeURL:  "https://oauth2.googleapis.com/device/code",
+	AuthorizeURL:   "https://accounts.google.com/o/oauth2/v2/auth",
+	TokenURL:       "https://oauth2.googleapis.com/token",
+	AppPasswordURL: "https://android.clients.google.com/auth",
+	Scope:          "https://www.googleapis.com/auth/skyjam",
+}
+
+func (e *AuthEndpoints) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&e.DeviceCodeURL, "google-device-code-url", defaultAuthEndpoints.DeviceCodeURL, "Where device logins get their code")
+	flags.StringVar(&e.AuthorizeURL, "google-authorize-url", defaultAuthEndpoints.AuthorizeURL, "Where browser logins are sent to sign in")
+	flags.StringVar(&e.TokenURL, "google-token-url", defaultAuthEndpoints.TokenURL, "Where OAuth tokens are obtained and refreshed")
+	flags.StringVar(&e.AppPasswordURL, "google-app-password-url", defaultAuthEndpoints.AppPasswordURL, "Where app-specific passwords are exchanged for a token")
+	flags.StringVar(&e.ClientID, "google-client-id", os.Getenv("PORTIFY_GOOGLE_CLIENT_ID"), "OAuth client ID for device and browser logins (env PORTIFY_GOOGLE_CLIENT_ID)")
+	flags.StringVar(&e.ClientSecret, "google-client-secret", os.Getenv("PORTIFY_GOOGLE_CLIENT_SECRET"), "OAuth client secret (env PORTIFY_GOOGLE_CLIENT_SECRET)")
+	flags.StringVar(&e.Scope, "google-scope", defaultAuthEndpoints.Scope, "OAuth scope requested for Google Music")
+}
+
+// What a Google login gave us. For app passwords, the password is kept as
+// the refresh token, as logging in again is the only way to refresh; it is
+// never saved, so a saved app password login lasts until Google rejects it.
+type Token struct {
+	Type         string    `json:"type"`
+	Email        string    `json:"email,omitempty"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// Whether the token can still be used for a while
+func (t *Token) valid() bool {
+	return t.AccessToken != "" && (t.Expiry.IsZero() || time.Now().Add(tokenExpiryMargin).Before(t.Expiry))
+}
+
+// The Authorization header of requests sent with the token
+func (t *Token) header() string {
+	if t.Type == tokenAppPassword {
+		return "GoogleLogin auth=" + t.AccessToken
+	}
+	return "Bearer " + t.AccessToken
+}
+
+// What the user needs to log in on another device
+type DeviceCode struct {
+	DeviceCode      string `json:"-"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// The response of the OAuth token endpoint, successful or not
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// Logs in to Google, keeps the token fresh and, given a store, remembers it
+// between runs
+type googleAuth struct {
+	endpoints AuthEndpoints
+	client    *http.Client
+	store     *tokenStore
+
+	mu    sync.Mutex
+	token *Token
+	// The refresh under way, if any
+	refreshing *tokenRefresh
+	// The state sent with each browser login not finished yet
+	states map[string]bool
+}
+
+// A refresh others can wait for instead of starting their own
+type tokenRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func newGoogleAuth(endpoints AuthEndpoints, client *http.Client) *googleAuth {
+	return &googleAuth{endpoints: endpoints, client: client, states: make(map[string]bool)}
+}
+
+func (a *googleAuth) loggedIn() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.token != nil
+}
+
+// Remembers the login in store from now on, picking up the one it holds.
+// A saved login that can't be read is reported, but replaced by the next.
+func (a *googleAuth) useStore(store *tokenStore) error {
+	token, err := store.Load()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store = store
+	if token != nil {
+		a.token = token
+	}
+	return err
+}
+
+// Replaces the token, saving it if there is a store
+func (a *googleAuth) setToken(token *Token) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.setTokenLocked(token)
+}
+
+func (a *googleAuth) setTokenLocked(token *Token) error {
+	a.token = token
+	if a.store == nil {
+		return nil
+	}
+	if token == nil {
+		return a.store.Clear()
+	}
+	if token.Type == tokenAppPassword {
+		// Keep the password out of the file, next to its key
+		saved := *token
+		saved.RefreshToken = ""
+		token = &saved
+	}
+	return a.store.Save(token)
+}
+
+// Returns the Authorization header for a request, refreshing the token
+// first if it expired
+func (a *googleAuth) header() (string, error) {
+	a.mu.Lock()
+	token := a.token
+	a.mu.Unlock()
+	if token != nil && !token.valid() {
+		if err := a.refresh(token); err != nil {
+			return "", err
+		}
+		a.mu.Lock()
+		token = a.token
+		a.mu.Unlock()
+	}
+	if token == nil {
+		return "", &AuthError{Service: "Google", StatusCode: 401}
+	}
+	return token.header(), nil
+}
+
+// Refreshes a token the service rejected, unless it was already replaced
+// since rejected was sent. Returns whether the request is worth retrying.
+func (a *googleAuth) refreshRejected(rejected string) bool {
+	a.mu.Lock()
+	token := a.token
+	a.mu.Unlock()
+	if token == nil || token.RefreshToken == "" {
+		return false
+	}
+	if token.header() != rejected {
+		return true
+	}
+	if err := a.refresh(token); err != nil {
+		fmt.Printf("Couldn't refresh Google login: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// Replaces stale with a fresh token. The request goes out without holding
+// a.mu, and only one at a time: callers arriving meanwhile wait for it.
+func (a *googleAuth) refresh(stale *Token) error {
+	a.mu.Lock()
+	if a.token != stale {
+		// Already refreshed, or logged in or out since
+		a.mu.Unlock()
+		return nil
+	}
+	if r := a.refreshing; r != nil {
+		a.mu.Unlock()
+		<-r.done
+		return r.err
+	}
+	r := &tokenRefresh{done: make(chan struct{})}
+	a.refreshing = r
+	a.mu.Unlock()
+
+	fresh, err := a.refreshToken(stale)
+
+	a.mu.Lock()
+	if a.token == stale {
+		if _, ok := err.(*AuthError); ok {
+			// The refresh token was revoked, so the user has to log in again
+			a.setTokenLocked(nil)
+		} else if err == nil {
+			err = a.setTokenLocked(fresh)
+		}
+	}
+	a.refreshing = nil
+	a.mu.Unlock()
+	r.err = err
+	close(r.done)
+	return err
+}
+
+// Asks Google for a token to replace token
+func (a *googleAuth) refreshToken(token *Token) (*Token, error) {
+	if token.RefreshToken == "" {
+		return nil, &AuthError{Service: "Google", StatusCode: 401}
+	}
+	if token.Type == tokenAppPassword {
+		return a.appPasswordToken(token.Email, token.RefreshToken)
+	}
+	fresh, err := a.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+	})
+	if fresh != nil && fresh.RefreshToken == "" {
+		// Refreshing doesn't always give a new refresh token
+		fresh.RefreshToken = token.RefreshToken
+	}
+	return fresh, err
+}
+
+// Logs in with an app-specific password
+func (a *googleAuth) loginAppPassword(email string, password string) error {
+	token, err := a.appPasswordToken(email, password)
+	if err != nil {
+		return err
+	}
+	return a.setToken(token)
+}
+
+func (a *googleAuth) appPasswordToken(email string, password string) (*Token, error) {
+	resp, err := a.client.PostForm(a.endpoints.AppPasswordURL,
+		url.Values{
+			"Email":       {email},
+			"Passwd":      {password},
+			"accountType": {"HOSTED_OR_GOOGLE"},
+			"source":      {"goportify"},
+			"service":     {"sj"},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("HTTP Error logging in: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return nil, &AuthError{Service: "Google", StatusCode: resp.StatusCode}
+	} else if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Login returned status code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading login body: %s", err)
+	}
+	authResponse, err := parseAuthResponse(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing auth response: %s", err)
+	}
+	if authResponse["Auth"] == "" {
+		return nil, fmt.Errorf("Didn't receive an auth response")
+	}
+
+	token := &Token{Type: tokenAppPassword, Email: email, AccessToken: authResponse["Auth"], RefreshToken: password}
+	if expiry, err := strconv.ParseInt(authResponse["Expiry"], 10, 64); err == nil {
+		token.Expiry = time.Unix(expiry, 0)
+	}
+	return token, nil
+}
+
+// Starts a login on another device: the user enters the returned code at
+// its verification URL, while pollDeviceToken waits for them
+func (a *googleAuth) requestDeviceCode() (*DeviceCode, error) {
+	if a.endpoints.ClientID == "" {
+		return nil, fmt.Errorf("Please configure a Google OAuth client ID")
+	}
+	resp, err := a.client.PostForm(a.endpoints.DeviceCodeURL, url.Values{
+		"client_id": {a.endpoints.ClientID},
+		"scope":     {a.endpoints.Scope},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("HTTP Error requesting a device code: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Device code request returned status code %d", resp.StatusCode)
+	}
+
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal json: %v", err)
+	}
+	if code.VerificationURL == "" {
+		code.VerificationURL = code.VerificationURI
+	}
+	if code.Interval <= 0 {
+		code.Interval = 5
+	}
+	return &DeviceCode{
+		DeviceCode:      code.DeviceCode,
+		UserCode:        code.UserCode,
+		VerificationURL: code.VerificationURL,
+		ExpiresIn:       code.ExpiresIn,
+		Interval:        code.Interval,
+	}, nil
+}
+
+// Waits for the user to enter a device code, then logs in with the token
+// it grants. Gives up when the code expires or cancel is closed.
+func (a *googleAuth) pollDeviceToken(code *DeviceCode, cancel <-chan struct{}) error {
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for {
+		select {
+		case <-time.After(interval):
+		case <-cancel:
+			return errCancelled
+		}
+		if code.ExpiresIn > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("The login code expired")
+		}
+
+		token, err := a.requestToken(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {code.DeviceCode},
+		})
+		if pending, ok := err.(*tokenError); ok {
+			switch pending.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += deviceSlowDown
+				continue
+			case "expired_token":
+				return fmt.Errorf("The login code expired")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return a.setToken(token)
+	}
+}
+
+// Returns where to send the user to log in with their browser, coming back
+// to redirectURL
+func (a *googleAuth) authCodeURL(redirectURL string) (string, error) {
+	if a.endpoints.ClientID == "" {
+		return "", fmt.Errorf("Please configure a Google OAuth client ID")
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(buf)
+	a.mu.Lock()
+	a.states[state] = true
+	a.mu.Unlock()
+
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.endpoints.ClientID},
+		"redirect_uri":  {redirectURL},
+		"scope":         {a.endpoints.Scope},
+		"state":         {state},
+		"access_type":   {"offline"},
+		"prompt":        {"consent"},
+	}
+	sep := "?"
+	if strings.Contains(a.endpoints.AuthorizeURL, "?") {
+		sep = "&"
+	}
+	return a.endpoints.AuthorizeURL + sep + v.Encode(), nil
+}
+
+// Finishes a browser login with the code it came back with
+func (a *googleAuth) exchangeCode(code string, state string, redirectURL string) error {
+	a.mu.Lock()
+	known := a.states[state]
+	delete(a.states, state)
+	a.mu.Unlock()
+	if !known {
+		return fmt.Errorf("Unknown login state, please try again")
+	}
+
+	token, err := a.requestToken(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	})
+	if err != nil {
+		return err
+	}
+	return a.setToken(token)
+}
+
+// An error the OAuth token endpoint answered with
+type tokenError struct {
+	Code        string
+	Description string
+}
+
+func (e *tokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("Google login failed: %s (%s)", e.Description, e.Code)
+	}
+	return fmt.Sprintf("Google login failed: %s", e.Code)
+}
+
+// Asks the OAuth token endpoint for a token. Revoked or expired grants are
+// returned as an *AuthError, other refusals as a *tokenError.
+func (a *googleAuth) requestToken(v url.Values) (*Token, error) {
+	v.Set("client_id", a.endpoints.ClientID)
+	if a.endpoints.ClientSecret != "" {
+		v.Set("client_secret", a.endpoints.ClientSecret)
+	}
+	resp, err := a.client.PostForm(a.endpoints.TokenURL, v)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP Error requesting a token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("Token request returned status code %d", resp.StatusCode)
+	}
+	if tr.Error == "invalid_grant" {
+		return nil, &AuthError{Service: "Google", StatusCode: resp.StatusCode}
+	} else if tr.Error != "" {
+		return nil, &tokenError{Code: tr.Error, Description: tr.Description}
+	} else if resp.StatusCode != 200 || tr.AccessToken == "" {
+		return nil, fmt.Errorf("Token request returned status code %d", resp.StatusCode)
+	}
+
+	token := &Token{Type: tokenOAuth, AccessToken: tr.AccessToken, RefreshToken: tr.RefreshToken}
+	if tr.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A token endpoint answering each request with the next of responses, the
+// last one over and over
+type tokenStub struct {
+	mu        sync.Mutex
+	responses []string
+	requests  int
+	// Closed to let requests be answered, if set
+	release chan struct{}
+}
+
+func (s *tokenStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.release != nil {
+		<-s.release
+	}
+	r.ParseForm()
+	s.mu.Lock()
+	response := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	s.requests++
+	s.mu.Unlock()
+
+	if strings.Contains(response, `"error"`) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprint(w, response)
+}
+
+func (s *tokenStub) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newStubAuth(stub http.Handler) (*googleAuth, *httptest.Server) {
+	server := httptest.NewServer(stub)
+	endpoints := AuthEndpoints{
+		DeviceCodeURL:  server.URL + "/device/code",
+		TokenURL:       server.URL + "/token",
+		AppPasswordURL: server.URL + "/auth",
+		ClientID:       "client",
+	}
+	return newGoogleAuth(endpoints, http.DefaultClient), server
+}
+
+func TestPollDeviceToken(t *testing.T) {
+	defer func(d time.Duration) { deviceSlowDown = d }(deviceSlowDown)
+	deviceSlowDown = 10 * time.Millisecond
+
+	stub := &tokenStub{responses: []string{
+		`{"error": "authorization_pending"}`,
+		`{"error": "slow_down"}`,
+		`{"error": "authorization_pending"}`,
+		`{"access_token": "access", "refresh_token": "refresh", "expires_in": 3600}`,
+	}}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+
+	if err := auth.pollDeviceToken(&DeviceCode{DeviceCode: "device", ExpiresIn: 60}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := stub.count(); n != 4 {
+		t.Errorf("polled %d times, want 4", n)
+	}
+	header, err := auth.header()
+	if err != nil || header != "Bearer access" {
+		t.Errorf("header() = %q, %v, want %q", header, err, "Bearer access")
+	}
+}
+
+func TestPollDeviceTokenExpiry(t *testing.T) {
+	defer func(d time.Duration) { deviceSlowDown = d }(deviceSlowDown)
+	deviceSlowDown = 400 * time.Millisecond
+
+	// Slowing down each time makes the code expire after a few polls
+	stub := &tokenStub{responses: []string{`{"error": "slow_down"}`}}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+
+	err := auth.pollDeviceToken(&DeviceCode{DeviceCode: "device", ExpiresIn: 1}, nil)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("polling returned %v, want the code to expire", err)
+	}
+	if auth.loggedIn() {
+		t.Errorf("logged in with an expired code")
+	}
+
+	// Google can also tell us itself
+	stub = &tokenStub{responses: []string{`{"error": "authorization_pending"}`, `{"error": "expired_token"}`}}
+	auth, server = newStubAuth(stub)
+	defer server.Close()
+	err = auth.pollDeviceToken(&DeviceCode{DeviceCode: "device", ExpiresIn: 60}, nil)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("polling returned %v, want the code to expire", err)
+	}
+}
+
+func TestPollDeviceTokenCancel(t *testing.T) {
+	stub := &tokenStub{responses: []string{`{"error": "authorization_pending"}`}}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+
+	cancel := make(chan struct{})
+	close(cancel)
+	code := &DeviceCode{DeviceCode: "device", ExpiresIn: 60, Interval: 60}
+	if err := auth.pollDeviceToken(code, cancel); err != errCancelled {
+		t.Errorf("polling returned %v, want %v", err, errCancelled)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	stub := &tokenStub{
+		responses: []string{`{"access_token": "fresh", "expires_in": 3600}`},
+		release:   make(chan struct{}),
+	}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+	auth.setToken(&Token{Type: tokenOAuth, AccessToken: "stale", RefreshToken: "refresh", Expiry: time.Now()})
+
+	var wg sync.WaitGroup
+	headers := make([]string, 5)
+	for i := range headers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			header, err := auth.header()
+			if err != nil {
+				t.Errorf("header() returned %v", err)
+			}
+			headers[i] = header
+		}(i)
+	}
+
+	// The refresh is stuck waiting for the stub, which mustn't block others
+	done := make(chan bool)
+	go func() { done <- auth.loggedIn() }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("loggedIn() blocked during a refresh")
+	}
+	close(stub.release)
+	wg.Wait()
+
+	for i, header := range headers {
+		if header != "Bearer fresh" {
+			t.Errorf("header %d is %q, want %q", i, header, "Bearer fresh")
+		}
+	}
+	if n := stub.count(); n != 1 {
+		t.Errorf("refreshed %d times, want once", n)
+	}
+	if auth.token.RefreshToken != "refresh" {
+		t.Errorf("refresh token %q wasn't kept", auth.token.RefreshToken)
+	}
+}
+
+func TestRefreshInvalidGrant(t *testing.T) {
+	stub := &tokenStub{responses: []string{`{"error": "invalid_grant", "error_description": "Token has been revoked."}`}}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := newTokenStore(filepath.Join(dir, "google_token"))
+	auth.useStore(store)
+	auth.setToken(&Token{Type: tokenOAuth, AccessToken: "stale", RefreshToken: "revoked", Expiry: time.Now()})
+
+	_, err := auth.header()
+	if _, ok := err.(*AuthError); !ok {
+		t.Errorf("header() returned %v, want an *AuthError", err)
+	}
+	if auth.loggedIn() {
+		t.Errorf("still logged in with a revoked token")
+	}
+	if token, err := store.Load(); token != nil || err != nil {
+		t.Errorf("store still holds %+v, %v", token, err)
+	}
+}
+
+func TestRefreshRejected(t *testing.T) {
+	stub := &tokenStub{responses: []string{`{"access_token": "fresh", "expires_in": 3600}`}}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+	auth.setToken(&Token{Type: tokenOAuth, AccessToken: "rejected", RefreshToken: "refresh"})
+
+	if !auth.refreshRejected("Bearer rejected") {
+		t.Fatalf("refreshing a rejected token failed")
+	}
+	// A request sent with the old token doesn't refresh again
+	if !auth.refreshRejected("Bearer rejected") {
+		t.Errorf("a request rejected before the refresh isn't worth retrying")
+	}
+	if n := stub.count(); n != 1 {
+		t.Errorf("refreshed %d times, want once", n)
+	}
+}
+
+func TestAppPasswordNotSaved(t *testing.T) {
+	stub := &tokenStub{responses: []string{"SID=sid\nAuth=auth\n"}}
+	auth, server := newStubAuth(stub)
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := newTokenStore(filepath.Join(dir, "google_token"))
+	auth.useStore(store)
+
+	if err := auth.loginAppPassword("me@gmail.com", "password"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "auth" || saved.RefreshToken != "" {
+		t.Errorf("saved %+v, want the token without the password", saved)
+	}
+	// It can still be refreshed until portify exits
+	if auth.token.RefreshToken != "password" {
+		t.Errorf("the password was forgotten")
+	}
+
+	// A saved login can't be refreshed, so a rejected one needs a new login
+	restored := newGoogleAuth(auth.endpoints, http.DefaultClient)
+	restored.useStore(store)
+	if restored.refreshRejected("GoogleLogin auth=auth") {
+		t.Errorf("a saved app password login was refreshed")
+	}
+}
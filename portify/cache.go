@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A previously chosen destination track for a source track
+type CachedMatch struct {
+	Nid        string    `json:"nid"`
+	Artist     string    `json:"artist"`
+	Title      string    `json:"title"`
+	Album      string    `json:"album"`
+	Confidence float64   `json:"confidence"`
+	Matched    time.Time `json:"matched"`
+	Karaoke    bool      `json:"karaoke,omitempty"`
+	// Chosen by the user when reviewing a transfer rather than by searching
+	Corrected bool `json:"corrected,omitempty"`
+}
+
+// Remembers matches across transfers, keyed by source track URI, so the same
+// track isn't searched for again
+type matchCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]CachedMatch
+	dirty   bool
+}
+
+// Loads the cache stored at path, starting empty if there is none yet
+func loadMatchCache(path string) (*matchCache, error) {
+	c := &matchCache{path: path, entries: make(map[string]CachedMatch)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading match cache: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("Error parsing match cache %s: %v", path, err)
+	}
+	return c, nil
+}
+
+func (c *matchCache) Get(uri string) (CachedMatch, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.entries[uri]
+	return m, ok
+}
+
+func (c *matchCache) Put(uri string, m CachedMatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[uri] = m
+	c.dirty = true
+}
+
+// Forgets the given tracks, returning how many were cached
+func (c *matchCache) Invalidate(uris ...string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for _, uri := range uris {
+		if _, ok := c.entries[uri]; ok {
+			delete(c.entries, uri)
+			removed++
+		}
+	}
+	if removed > 0 {
+		c.dirty = true
+	}
+	return removed
+}
+
+// Forgets every match, including the corrections made by the user
+func (c *matchCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]CachedMatch)
+	c.dirty = true
+}
+
+// Forgets every match found by searching, keeping the corrections made by
+// the user. Returns how many corrections were kept.
+func (c *matchCache) ClearUncorrected() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := 0
+	for uri, m := range c.entries {
+		if m.Corrected {
+			kept++
+		} else {
+			delete(c.entries, uri)
+		}
+	}
+	c.dirty = true
+	return kept
+}
+
+// Returns a copy of every cached match
+func (c *matchCache) Entries() map[string]CachedMatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make(map[string]CachedMatch, len(c.entries))
+	for uri, m := range c.entries {
+		entries[uri] = m
+	}
+	return entries
+}
+
+// Writes the cache to disk if it changed since it was last saved
+func (c *matchCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling match cache: %v", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return fmt.Errorf("Error writing match cache: %v", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// Replaces the file at path, so it's never left half written
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type CacheInvalidateRequest struct {
+	Uris []string `json:"uris"`
+}
+
+// Lists every cached match, or only the one for the uri query parameter
+func (s *Server) cacheList(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	if uri := r.URL.Query().Get("uri"); uri != "" {
+		if m, ok := s.cache.Get(uri); ok {
+			response = &Response{Status: 200, Message: "ok", Data: m}
+		} else {
+			response = &Response{Status: 404, Message: "Track is not cached."}
+		}
+	} else {
+		response = &Response{Status: 200, Message: "ok", Data: s.cache.Entries()}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (s *Server) cacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	if r.Method != "POST" {
+		http.Error(w, "Use a POST to invalidate matches", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var invalidateReq CacheInvalidateRequest
+	err := json.NewDecoder(r.Body).Decode(&invalidateReq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid tracks specified: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	removed := s.cache.Invalidate(invalidateReq.Uris...)
+	if err := s.cache.Save(); err != nil {
+		response = &Response{Status: 500, Message: err.Error()}
+	} else {
+		response = &Response{Status: 200, Message: fmt.Sprintf("%d matches invalidated.", removed)}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (s *Server) cacheClear(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	if r.Method != "POST" {
+		http.Error(w, "Use a POST to clear the match cache", http.StatusMethodNotAllowed)
+		return
+	}
+
+	message := "match cache cleared."
+	if r.URL.Query().Get("keep_corrected") == "true" {
+		message = fmt.Sprintf("match cache cleared, %d corrections kept.", s.cache.ClearUncorrected())
+	} else {
+		s.cache.Clear()
+	}
+	if err := s.cache.Save(); err != nil {
+		response = &Response{Status: 500, Message: err.Error()}
+	} else {
+		response = &Response{Status: 200, Message: message}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rckclmbr/goportify/Godeps/_workspace/src/code.google.com/p/go-uuid/uuid"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prints transfer events to stdout for the headless transfer command
+type consoleEmitter struct{}
+
+func (consoleEmitter) Emit(event string, args ...interface{}) error {
+	for _, arg := range args {
+		resp, ok := arg.(*SocketIOResponse)
+		if !ok {
+			continue
+		}
+		switch data := resp.Data.(type) {
+		case PlaylistType:
+			switch resp.Type {
+			case "playlist_started":
+				fmt.Printf("Started playlist '%s'\n", data.Name)
+			case "playlist_done":
+				fmt.Printf("Finished playlist '%s'\n", data.Name)
+			}
+		case AuthRequiredType:
+			fmt.Printf("%s rejected our credentials, please log in again\n", data.Service)
+		case PlaylistLengthType:
+			fmt.Printf("Playlist has %d tracks\n", data.Length)
+		case ProgressType:
+			if data.Done == data.Total {
+				fmt.Printf("Matched %d tracks (%.1f tracks/s)\n", data.Done, data.TracksPerSecond)
+			}
+		}
+	}
+	return nil
+}
+
+// Runs a transfer without the web interface. Returns the process exit code:
+// 0 when every track was matched, 1 when some tracks couldn't be found and 2
+// when the transfer couldn't run at all.
+func runTransferCommand(args []string) int {
+	flags := flag.NewFlagSet("transfer", flag.ContinueOnError)
+	googleEmail := flags.String("google-email", os.Getenv("PORTIFY_GOOGLE_EMAIL"), "Google account email (env PORTIFY_GOOGLE_EMAIL)")
+	googlePassword := flags.String("google-password", os.Getenv("PORTIFY_GOOGLE_PASSWORD"), "Google app-specific password, not needed once logged in (env PORTIFY_GOOGLE_PASSWORD)")
+	spotifyUsername := flags.String("spotify-username", os.Getenv("PORTIFY_SPOTIFY_USERNAME"), "Spotify username (env PORTIFY_SPOTIFY_USERNAME)")
+	spotifyPassword := flags.String("spotify-password", os.Getenv("PORTIFY_SPOTIFY_PASSWORD"), "Spotify password (env PORTIFY_SPOTIFY_PASSWORD)")
+	playlistNames := flags.String("playlists", "", "Comma separated names or URIs of the playlists to transfer")
+	sourceFlag := flags.String("source", defaultSource, "Where the playlists are read from: spotify (google can only be exported)")
+	playlistFiles := flags.String("files", "", "Comma separated M3U, M3U8, XSPF or CSV files to transfer instead of Spotify playlists")
+	dryRun := flags.Bool("dry-run", false, "Only report how tracks would be matched, without creating any playlist")
+	workers := flags.Int("workers", defaultSettings.Workers, "How many tracks are matched at once")
+	googleRate := flags.Float64("google-rate", defaultSettings.GoogleRequestsPerSecond, "Maximum Google requests per second, 0 for no limit")
+	googleBurst := flags.Int("google-burst", defaultSettings.GoogleBurst, "Maximum Google requests sent in a burst")
+	nameTemplate := flags.String("name-template", defaultSettings.PlaylistNameTemplate, "Template naming the Google copy of a playlist, given its .Name and .Folders")
+	syncPlaylists := flags.Bool("sync", false, "Update the Google playlists created by earlier transfers instead of creating new ones")
+	syncRemove := flags.Bool("sync-remove", false, "When syncing, also remove tracks that are no longer in the Spotify playlist")
+	starredRatings := flags.Bool("starred-ratings", false, "Give the starred tracks a thumbs up on Google instead of copying them to a playlist")
+	starredLibrary := flags.Bool("starred-library", false, "With -starred-ratings, also add the starred tracks to the Google library")
+	resumeId := flags.String("resume", "", "ID of an interrupted transfer to pick up where it stopped")
+	reportPath := flags.String("report", "", "File to write the unmatched tracks report to, as CSV if it ends in .csv and JSON otherwise (default <report-dir>/<transfer id>.csv)")
+	var paths Paths
+	paths.registerFlags(flags)
+	var endpoints AuthEndpoints
+	endpoints.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	settings := Settings{
+		Workers:                 *workers,
+		GoogleRequestsPerSecond: *googleRate,
+		GoogleBurst:             *googleBurst,
+		PlaylistNameTemplate:    *nameTemplate,
+	}
+	if err := settings.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *playlistNames == "" && *playlistFiles == "" && *resumeId == "" {
+		fmt.Fprintln(os.Stderr, "Please select at least one playlist with -playlists or -files")
+		return 2
+	}
+
+	cache, err := loadMatchCache(paths.MatchCache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	mappings, err := loadPlaylistMappings(paths.PlaylistMappings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	goog := NewGoogle(endpoints)
+	goog.SetRateLimit(settings.GoogleRequestsPerSecond, settings.GoogleBurst)
+	if err := loginGoogle(goog, paths.GoogleToken, *googleEmail, *googlePassword); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var journal *Journal
+	sourceName := *sourceFlag
+	if *resumeId != "" {
+		journal, err = loadJournal(paths.Journals, *resumeId)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		sourceName = journal.Source
+	} else if *playlistFiles != "" {
+		sourceName = fileSourceName
+	}
+	if err := checkTransferServices(sourceName, defaultDestination); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var src Source
+	var playlists []Playlist
+	switch sourceName {
+	case fileSourceName:
+		src, playlists, err = openPlaylistFiles(journal, *playlistFiles)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	case "spotify":
+		sp, err := loginSpotify(*spotifyUsername, *spotifyPassword)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		src = sp
+		playlists = sp.AllPlaylists()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown source %q\n", sourceName)
+		return 2
+	}
+
+	if journal != nil {
+		playlists = journal.Playlists
+		*syncPlaylists = journal.Sync
+		*syncRemove = journal.SyncRemove
+		*starredRatings = journal.StarredRatings
+		*starredLibrary = journal.StarredLibrary
+	} else {
+		if *playlistNames != "" {
+			playlists, err = selectPlaylists(playlists, strings.Split(*playlistNames, ","))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+		if err := checkStarredRatings(goog, *starredRatings); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if !*dryRun {
+			journal, err = newJournal(paths.Journals, uuid.New(), &TransferRequest{
+				Source:         sourceName,
+				Destination:    defaultDestination,
+				Playlists:      playlists,
+				Sync:           *syncPlaylists,
+				SyncRemove:     *syncRemove,
+				StarredRatings: *starredRatings,
+				StarredLibrary: *starredLibrary,
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			fmt.Printf("Transfer %s started, resume it with -resume %s if interrupted\n", journal.ID, journal.ID)
+		}
+	}
+
+	t := newTransfer(consoleEmitter{}, src, goog)
+	if journal != nil {
+		t.id = journal.ID
+	} else {
+		t.id = uuid.New()
+	}
+	t.dryRun = *dryRun
+	t.workers = settings.Workers
+	t.nameTemplate, _ = parsePlaylistNameTemplate(settings.PlaylistNameTemplate)
+	t.cache = cache
+	t.journal = journal
+	t.sync = *syncPlaylists
+	t.syncRemove = *syncRemove
+	t.starredRatings = *starredRatings
+	t.starredLibrary = *starredLibrary
+	t.mappings = mappings
+
+	// Stop cleanly on Ctrl-C, leaving the journal to resume from
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		fmt.Fprintln(os.Stderr, "Cancelling transfer...")
+		t.cancel()
+	}()
+
+	t.run(playlists)
+	signal.Stop(interrupts)
+
+	if *reportPath == "" {
+		*reportPath = filepath.Join(paths.Reports, t.id+".csv")
+	}
+	if err := writeReportFile(*reportPath, unmatchedTracks(t.matchReport())); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		fmt.Printf("Unmatched tracks written to %s\n", *reportPath)
+	}
+
+	if err := t.aborted(); err != nil {
+		fmt.Fprintf(os.Stderr, "Transfer aborted: %s\n", err)
+		return 2
+	}
+
+	if t.dryRun {
+		printMatchReport(t.matchReport())
+	}
+
+	found, lowConfidence, notFound := t.counts()
+	addFailed := t.addFailures()
+	fmt.Printf("%d tracks matched (%d with low confidence), %d not found, %d rejected by Google\n", found, lowConfidence, notFound, addFailed)
+	if notFound > 0 || addFailed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Backs up Spotify or Google playlists as M3U8, XSPF and JSON. Only logs in
+// to the service exported from. Returns the process exit code.
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	sourceName := flags.String("source", defaultSource, "Where the playlists are read from: spotify or google")
+	googleEmail := flags.String("google-email", os.Getenv("PORTIFY_GOOGLE_EMAIL"), "Google account email (env PORTIFY_GOOGLE_EMAIL)")
+	googlePassword := flags.String("google-password", os.Getenv("PORTIFY_GOOGLE_PASSWORD"), "Google app-specific password, not needed once logged in (env PORTIFY_GOOGLE_PASSWORD)")
+	spotifyUsername := flags.String("spotify-username", os.Getenv("PORTIFY_SPOTIFY_USERNAME"), "Spotify username (env PORTIFY_SPOTIFY_USERNAME)")
+	spotifyPassword := flags.String("spotify-password", os.Getenv("PORTIFY_SPOTIFY_PASSWORD"), "Spotify password (env PORTIFY_SPOTIFY_PASSWORD)")
+	playlistNames := flags.String("playlists", "", "Comma separated names, URIs or folders of the playlists to export (default all)")
+	out := flags.String("out", filepath.Join("tmp", "exports", time.Now().Format("20060102-150405")), "Directory to export to, or zip archive if it ends in .zip")
+	var paths Paths
+	paths.registerFlags(flags)
+	var endpoints AuthEndpoints
+	endpoints.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var src Source
+	switch *sourceName {
+	case "google":
+		goog := NewGoogle(endpoints)
+		if err := loginGoogle(goog, paths.GoogleToken, *googleEmail, *googlePassword); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		src = goog
+	case "spotify":
+		sp, err := loginSpotify(*spotifyUsername, *spotifyPassword)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		src = sp
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown source %q\n", *sourceName)
+		return 2
+	}
+
+	var err error
+	playlists := src.AllPlaylists()
+	if *playlistNames != "" {
+		playlists, err = selectPlaylists(playlists, strings.Split(*playlistNames, ","))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	// Stop cleanly on Ctrl-C, without writing a partial export
+	cancel := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		fmt.Fprintln(os.Stderr, "Cancelling export...")
+		close(cancel)
+	}()
+
+	exported, err := exportPlaylists(src, playlists, cancel)
+	signal.Stop(interrupts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := writeExportPath(*out, exported); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	tracks := 0
+	for _, playlist := range exported {
+		tracks += len(playlist.Tracks)
+	}
+	fmt.Printf("Exported %d playlists with %d tracks to %s\n", len(exported), tracks, *out)
+	return 0
+}
+
+// Inspects or edits the match cache. With no arguments lists every cached
+// match, "invalidate" forgets the given track URIs, "clear" forgets all and
+// "clear-uncorrected" all but the corrections made when reviewing.
+func runCacheCommand(args []string) int {
+	flags := flag.NewFlagSet("cache", flag.ContinueOnError)
+	var paths Paths
+	paths.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cache, err := loadMatchCache(paths.MatchCache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	args = flags.Args()
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "list":
+		for uri, m := range cache.Entries() {
+			fmt.Printf("%s -> %s - %s (%s, %.2f, %s)\n", uri, m.Artist, m.Title, m.Nid, m.Confidence, m.Matched.Format(time.RFC3339))
+		}
+		return 0
+	case "invalidate":
+		fmt.Printf("%d matches invalidated\n", cache.Invalidate(args[1:]...))
+	case "clear":
+		cache.Clear()
+		fmt.Println("Match cache cleared")
+	case "clear-uncorrected":
+		fmt.Printf("Match cache cleared, %d corrections kept\n", cache.ClearUncorrected())
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown cache command '%s'\n", command)
+		return 2
+	}
+
+	if err := cache.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
+
+// Logs in to Google once and for all, with an app-specific password or on
+// another device, keeping the login for the other commands. Returns the
+// process exit code.
+func runLoginCommand(args []string) int {
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	googleEmail := flags.String("google-email", os.Getenv("PORTIFY_GOOGLE_EMAIL"), "Google account email (env PORTIFY_GOOGLE_EMAIL)")
+	googlePassword := flags.String("google-password", os.Getenv("PORTIFY_GOOGLE_PASSWORD"), "Google app-specific password (env PORTIFY_GOOGLE_PASSWORD)")
+	device := flags.Bool("device", false, "Log in by entering a code on another device instead of with a password")
+	logout := flags.Bool("logout", false, "Forget the saved Google login")
+	var paths Paths
+	paths.registerFlags(flags)
+	var endpoints AuthEndpoints
+	endpoints.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	goog := NewGoogle(endpoints)
+	if err := goog.PersistLogin(newTokenStore(paths.GoogleToken)); err != nil {
+		// A login that can't be read is replaced by the new one
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	if *logout {
+		if err := goog.Logout(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		fmt.Println("Google login forgotten")
+		return 0
+	}
+
+	if *device {
+		code, err := goog.RequestDeviceCode()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		fmt.Printf("Go to %s and enter the code %s\n", code.VerificationURL, code.UserCode)
+
+		cancel := make(chan struct{})
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		go func() {
+			<-interrupts
+			close(cancel)
+		}()
+		err = goog.WaitForDeviceLogin(code, cancel)
+		signal.Stop(interrupts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		if *googlePassword == "" {
+			fmt.Fprintln(os.Stderr, "Please give an app-specific password with -google-password, or use -device")
+			return 2
+		}
+		if err := goog.Login(*googleEmail, *googlePassword); err != nil {
+			fmt.Fprintf(os.Stderr, "Google login failed: %s\n", err)
+			return 2
+		}
+	}
+	fmt.Printf("Logged in to Google, the login is kept in %s\n", paths.GoogleToken)
+	return 0
+}
+
+// Logs in to Google with an app-specific password if one is given, or else
+// with the login kept by an earlier run
+func loginGoogle(goog *Google, tokenPath string, email string, password string) error {
+	if err := goog.PersistLogin(newTokenStore(tokenPath)); err != nil && password == "" {
+		return err
+	}
+	if password != "" {
+		if err := goog.Login(email, password); err != nil {
+			return fmt.Errorf("Google login failed: %s", err)
+		}
+	} else if !goog.LoggedIn() {
+		return fmt.Errorf("Not logged in to Google, run portify login or give -google-password")
+	}
+	return nil
+}
+
+func loginSpotify(username string, password string) (*Spotify, error) {
+	sp, err := NewSpotify()
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing spotify: %s", err)
+	}
+	if err := sp.Login(username, password); err != nil {
+		return nil, fmt.Errorf("Spotify login failed: %s", err)
+	}
+	return sp, nil
+}
+
+// Opens the playlist files to transfer: those of the journal when resuming,
+// or the comma separated files given otherwise
+func openPlaylistFiles(journal *Journal, fileList string) (*FileSource, []Playlist, error) {
+	var files []string
+	if journal != nil {
+		for _, playlist := range journal.Playlists {
+			files = append(files, strings.TrimPrefix(playlist.Uri, filePlaylistPrefix))
+		}
+	} else {
+		for _, file := range strings.Split(fileList, ",") {
+			if file = strings.TrimSpace(file); file == "" {
+				continue
+			}
+			// Absolute paths keep working when resuming from elsewhere
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, abs)
+		}
+	}
+
+	playlists := []Playlist{}
+	for _, file := range files {
+		playlist, _, err := readPlaylistFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Couldn't read playlist %s: %v", file, err)
+		}
+		playlists = append(playlists, playlist)
+	}
+	return newFileSource("", files...), playlists, nil
+}
+
+// Picks the playlists matching the given names or URIs
+func selectPlaylists(all []Playlist, wanted []string) ([]Playlist, error) {
+	var selected []Playlist
+	for _, want := range wanted {
+		want = strings.TrimSpace(want)
+		if want == "" {
+			continue
+		}
+		found := false
+		for _, playlist := range all {
+			if playlist.Name == want || playlist.Uri == want {
+				selected = append(selected, playlist)
+				found = true
+				break
+			}
+		}
+		if !found {
+			// A folder path, like "Work/Focus", selects every playlist in it
+			folder := strings.Split(want, "/")
+			for i := range folder {
+				folder[i] = strings.TrimSpace(folder[i])
+			}
+			for _, playlist := range all {
+				if inFolder(playlist, folder) {
+					selected = append(selected, playlist)
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No playlist or folder named '%s'", want)
+		}
+	}
+	return selected, nil
+}
+
+// Whether a playlist is in the given folder, or in one of its subfolders
+func inFolder(playlist Playlist, folder []string) bool {
+	if len(playlist.Folders) < len(folder) {
+		return false
+	}
+	for i, name := range folder {
+		if playlist.Folders[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func printMatchReport(report []*PlaylistReport) {
+	for _, playlist := range report {
+		fmt.Printf("\n%s\n", playlist.Playlist.Name)
+		if playlist.NotStarted {
+			fmt.Printf("  not started\n")
+		}
+		for _, match := range playlist.Tracks {
+			if match.Found {
+				fmt.Printf("  %s (%s) -> %s - %s (%s) [%s %.2f]\n", match.SpotifyTrackName, match.SpotifyTrackUri,
+					match.GoogleArtist, match.GoogleTitle, match.GoogleNid, match.Status, match.Confidence)
+			} else {
+				fmt.Printf("  %s (%s) -> not found\n", match.SpotifyTrackName, match.SpotifyTrackUri)
+			}
+		}
+	}
+}
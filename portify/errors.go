@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The transfer was cancelled while waiting on a service
+var errCancelled = errors.New("Transfer cancelled")
+
+// The service rejected our credentials, the user needs to log in again
+type AuthError struct {
+	Service    string
+	StatusCode int
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: authentication expired (status %d)", e.Service, e.StatusCode)
+}
+
+// The service kept throttling us even after retrying
+type RateLimitError struct {
+	Service    string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: rate limited, retry after %s", e.Service, e.RetryAfter)
+}
+
+// The requested resource doesn't exist
+type NotFoundError struct {
+	Service string
+	URL     string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s: %s not found", e.Service, e.URL)
+}
+
+// The service kept failing even after retrying
+type ServerError struct {
+	Service    string
+	StatusCode int
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s: server error (status %d)", e.Service, e.StatusCode)
+}
+
+// A request failed on its way to or from the service. Unless no connection
+// could be made, the service may have got it all the same.
+type NetworkError struct {
+	Service string
+	Err     error
+	// No connection could be made, so the request was never sent
+	Connect bool
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("%s: network error: %v", e.Service, e.Err)
+}
+
+// Some entries of a batch mutation were rejected, the others went through
+type MutationError struct {
+	Service  string
+	Failures []MutationFailure
+}
+
+type MutationFailure struct {
+	TrackId      string `json:"track_id"`
+	ResponseCode string `json:"response_code"`
+}
+
+func (e *MutationError) Error() string {
+	return fmt.Sprintf("%s: %d entries were rejected", e.Service, len(e.Failures))
+}
+
+// The only good enough candidates for a track were karaoke, cover or
+// tribute versions, and the track isn't one
+type KaraokeOnlyError struct {
+	Track string
+}
+
+func (e *KaraokeOnlyError) Error() string {
+	return fmt.Sprintf("Only karaoke or cover versions of %s", e.Track)
+}
+
+func isAuthError(err error) bool {
+	_, ok := err.(*AuthError)
+	return ok
+}
+
+// Whether err is one of the typed errors a request to a service fails with.
+// They are returned as they are, so callers can tell them apart.
+func isServiceError(err error) bool {
+	switch err.(type) {
+	case *AuthError, *RateLimitError, *NotFoundError, *ServerError, *NetworkError:
+		return true
+	}
+	return false
+}
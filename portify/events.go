@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rckclmbr/goportify/Godeps/_workspace/src/github.com/googollee/go-socket.io"
+	"sync"
+	"time"
+)
+
+// How long the events of a finished job are kept for clients to catch up on
+const eventLogGrace = 5 * time.Minute
+
+type SubscribeRequest struct {
+	ID    string `json:"id"`
+	Since int    `json:"since"`
+}
+
+// The socket.io room the events of a job are sent to
+func jobRoom(id string) string {
+	return "job:" + id
+}
+
+// Every event emitted for a job, so clients subscribing late or reconnecting
+// mid-transfer can catch up on what they missed
+type eventLog struct {
+	mu     sync.Mutex
+	events []loggedEvent
+	// How many running jobs emit to the log. It is dropped once none do.
+	emitters int
+}
+
+type loggedEvent struct {
+	name string
+	resp *numberedResponse
+}
+
+// A SocketIOResponse with its position in the event log
+type numberedResponse struct {
+	*SocketIOResponse
+	Seq int `json:"seq"`
+}
+
+// Returns the event log of a job, creating it if needed
+func (s *Server) eventLog(id string) *eventLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log, ok := s.eventLogs[id]
+	if !ok {
+		log = &eventLog{}
+		s.eventLogs[id] = log
+	}
+	return log
+}
+
+// Sends the events of a job to every socket subscribed to it. Every event is
+// numbered so subscribers can tell which ones they have already seen.
+type jobEmitter struct {
+	s   *Server
+	id  string
+	log *eventLog
+}
+
+func newJobEmitter(s *Server, id string) *jobEmitter {
+	log := s.eventLog(id)
+	log.mu.Lock()
+	log.emitters++
+	log.mu.Unlock()
+	return &jobEmitter{s: s, id: id, log: log}
+}
+
+// Called once the job is over. Its event log is dropped after grace, unless
+// the job was resumed in the meantime.
+func (e *jobEmitter) release(grace time.Duration) {
+	e.log.mu.Lock()
+	e.log.emitters--
+	e.log.mu.Unlock()
+
+	time.AfterFunc(grace, func() {
+		e.s.mu.Lock()
+		defer e.s.mu.Unlock()
+		if e.s.eventLogs[e.id] != e.log {
+			return
+		}
+		e.log.mu.Lock()
+		defer e.log.mu.Unlock()
+		if e.log.emitters == 0 {
+			delete(e.s.eventLogs, e.id)
+		}
+	})
+}
+
+func (e *jobEmitter) Emit(event string, args ...interface{}) error {
+	e.log.mu.Lock()
+	defer e.log.mu.Unlock()
+	for i, arg := range args {
+		if resp, ok := arg.(*SocketIOResponse); ok {
+			numbered := &numberedResponse{resp, len(e.log.events) + 1}
+			e.log.events = append(e.log.events, loggedEvent{event, numbered})
+			args[i] = numbered
+		}
+	}
+	e.s.sios.BroadcastTo(jobRoom(e.id), event, args...)
+	return nil
+}
+
+// Joins a socket to the room of a job, first replaying the events after
+// req.Since it missed
+func (s *Server) subscribe(so socketio.Socket, req SubscribeRequest) {
+	if req.ID == "" {
+		return
+	}
+	// Jobs that are unknown or long finished have nothing to replay
+	s.mu.Lock()
+	log, ok := s.eventLogs[req.ID]
+	s.mu.Unlock()
+	if ok {
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		if req.Since < 0 || req.Since > len(log.events) {
+			req.Since = 0
+		}
+		for _, event := range log.events[req.Since:] {
+			so.Emit(event.name, event.resp)
+		}
+	}
+	if err := so.Join(jobRoom(req.ID)); err != nil {
+		fmt.Printf("Couldn't subscribe to job %s: %v\n", req.ID, err)
+	}
+}
+
+// The default socket.io broadcast adaptor isn't safe to use from several
+// goroutines, but transfers emit from their workers while sockets come and go
+type lockedBroadcast struct {
+	mu    sync.RWMutex
+	rooms map[string]map[string]socketio.Socket
+}
+
+func newLockedBroadcast() *lockedBroadcast {
+	return &lockedBroadcast{rooms: make(map[string]map[string]socketio.Socket)}
+}
+
+func (b *lockedBroadcast) Join(room string, so socketio.Socket) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sockets, ok := b.rooms[room]
+	if !ok {
+		sockets = make(map[string]socketio.Socket)
+		b.rooms[room] = sockets
+	}
+	sockets[so.Id()] = so
+	return nil
+}
+
+func (b *lockedBroadcast) Leave(room string, so socketio.Socket) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sockets, ok := b.rooms[room]
+	if !ok {
+		return nil
+	}
+	delete(sockets, so.Id())
+	if len(sockets) == 0 {
+		delete(b.rooms, room)
+	}
+	return nil
+}
+
+func (b *lockedBroadcast) Send(ignore socketio.Socket, room, message string, args ...interface{}) error {
+	b.mu.RLock()
+	sockets := make([]socketio.Socket, 0, len(b.rooms[room]))
+	for id, so := range b.rooms[room] {
+		if ignore != nil && ignore.Id() == id {
+			continue
+		}
+		sockets = append(sockets, so)
+	}
+	b.mu.RUnlock()
+
+	for _, so := range sockets {
+		so.Emit(message, args...)
+	}
+	return nil
+}
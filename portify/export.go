@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The file of an export holding every playlist with all we know of it
+const exportIndexName = "playlists.json"
+
+// A playlist as it is backed up, with its tracks
+type ExportedPlaylist struct {
+	Uri     string          `json:"uri"`
+	Name    string          `json:"name"`
+	Folders []string        `json:"folders"`
+	Tracks  []ExportedTrack `json:"tracks"`
+}
+
+type ExportedTrack struct {
+	Position    int      `json:"position"`
+	Uri         string   `json:"uri"`
+	Title       string   `json:"title"`
+	Artists     []string `json:"artists"`
+	Album       string   `json:"album"`
+	AlbumArtist string   `json:"album_artist"`
+	DurationMs  int64    `json:"duration_ms"`
+	Disc        int      `json:"disc"`
+	Index       int      `json:"index"`
+	IsLocal     bool     `json:"is_local"`
+	Available   bool     `json:"available"`
+}
+
+// Where the files of an export are written: a directory or a zip archive
+type exportTarget interface {
+	WriteFile(name string, content []byte) error
+	Close() error
+}
+
+// Writes an export into a directory, creating it if needed
+type dirExport struct {
+	dir string
+}
+
+func (d dirExport) WriteFile(name string, content []byte) error {
+	file := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+func (d dirExport) Close() error {
+	return nil
+}
+
+// Writes an export as a zip archive
+type zipExport struct {
+	zw *zip.Writer
+}
+
+func newZipExport(w io.Writer) *zipExport {
+	return &zipExport{zw: zip.NewWriter(w)}
+}
+
+func (z *zipExport) WriteFile(name string, content []byte) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetModTime(time.Now())
+	w, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func (z *zipExport) Close() error {
+	return z.zw.Close()
+}
+
+// Reads every track of the given playlists. Closing cancel stops early,
+// with errCancelled.
+func exportPlaylists(src Source, playlists []Playlist, cancel <-chan struct{}) ([]ExportedPlaylist, error) {
+	exported := []ExportedPlaylist{}
+	for _, p := range playlists {
+		playlist := p
+		fmt.Printf("Exporting playlist '%s'\n", playlist.Name)
+		e := ExportedPlaylist{Uri: playlist.Uri, Name: playlist.Name, Folders: playlist.Folders, Tracks: []ExportedTrack{}}
+		if e.Folders == nil {
+			e.Folders = []string{}
+		}
+
+		trackChan, _ := src.PlaylistTracks(&playlist, cancel)
+		for track := range trackChan {
+			e.Tracks = append(e.Tracks, ExportedTrack{
+				Position:    len(e.Tracks),
+				Uri:         track.Uri,
+				Title:       track.Title,
+				Artists:     track.Artists,
+				Album:       track.Album,
+				AlbumArtist: track.AlbumArtist,
+				DurationMs:  int64(track.Duration / time.Millisecond),
+				Disc:        track.Disc,
+				Index:       track.Index,
+				IsLocal:     track.IsLocal,
+				Available:   track.Available,
+			})
+		}
+		if isClosed(cancel) {
+			return nil, errCancelled
+		}
+		exported = append(exported, e)
+	}
+	return exported, nil
+}
+
+// Writes every playlist as M3U8 and XSPF, in directories after the folders
+// it is in, and all of them to playlists.json
+func writeExport(target exportTarget, exported []ExportedPlaylist) error {
+	index, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := target.WriteFile(exportIndexName, index); err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, playlist := range exported {
+		name := exportFileName(playlist, used)
+		if err := target.WriteFile(name+".m3u8", exportM3U(playlist)); err != nil {
+			return err
+		}
+		xspf, err := exportXSPF(playlist)
+		if err != nil {
+			return err
+		}
+		if err := target.WriteFile(name+".xspf", xspf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names the files of a playlist after its folders and name, numbering
+// playlists that would otherwise share them
+func exportFileName(playlist ExportedPlaylist, used map[string]bool) string {
+	parts := []string{}
+	for _, folder := range playlist.Folders {
+		parts = append(parts, safeFileName(folder))
+	}
+	base := path.Join(append(parts, safeFileName(playlist.Name))...)
+
+	name := base
+	for n := 2; used[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)", base, n)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+// Replaces the characters file systems don't allow in names
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return "Untitled"
+	}
+	return name
+}
+
+// Writes a playlist as M3U8, which the file source reads back
+func exportM3U(playlist ExportedPlaylist) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&buf, "#PLAYLIST:%s\n", oneLine(playlist.Name))
+	for _, track := range playlist.Tracks {
+		seconds := int64(-1)
+		if track.DurationMs > 0 {
+			seconds = (track.DurationMs + 500) / 1000
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n", seconds, oneLine(exportTrackName(track)))
+		if track.Album != "" {
+			fmt.Fprintf(&buf, "#EXTALB:%s\n", oneLine(track.Album))
+		}
+		buf.WriteString(track.Uri + "\n")
+	}
+	return buf.Bytes()
+}
+
+// Writes a playlist as XSPF
+func exportXSPF(playlist ExportedPlaylist) ([]byte, error) {
+	x := xspfPlaylist{Xmlns: xspfNamespace, Version: "1", Title: playlist.Name}
+	for _, track := range playlist.Tracks {
+		x.Tracks = append(x.Tracks, xspfTrack{
+			Location: track.Uri,
+			Title:    track.Title,
+			Creator:  strings.Join(track.Artists, ", "),
+			Album:    track.Album,
+			Duration: track.DurationMs,
+			TrackNum: track.Index,
+		})
+	}
+	body, err := xml.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
+
+// Names a track "Artist - Title" like the M3U files players write
+func exportTrackName(track ExportedTrack) string {
+	if len(track.Artists) == 0 {
+		return track.Title
+	}
+	return strings.Join(track.Artists, ", ") + " - " + track.Title
+}
+
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Exports every playlist to a directory, or a zip archive if the path ends
+// in .zip
+func writeExportPath(out string, exported []ExportedPlaylist) error {
+	if strings.ToLower(filepath.Ext(out)) != ".zip" {
+		target := dirExport{out}
+		if err := writeExport(target, exported); err != nil {
+			return fmt.Errorf("Error writing export: %v", err)
+		}
+		return target.Close()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return fmt.Errorf("Error creating export directory: %v", err)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("Error creating export: %v", err)
+	}
+	target := newZipExport(f)
+	if err := writeExport(target, exported); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing export: %v", err)
+	}
+	if err := target.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing export: %v", err)
+	}
+	return f.Close()
+}
+
+// Serves GET /spotify/export, a zip archive backing up every Spotify
+// playlist, or those named in ?playlists=. Only needs a Spotify login.
+func (s *Server) spotifyExport(w http.ResponseWriter, r *http.Request) {
+	s.exportSource(w, r, s.sp, "spotify", &Response{Status: 402, Message: "Spotify: not logged in"})
+}
+
+// Serves GET /google/export, like /spotify/export for Google playlists
+func (s *Server) googleExport(w http.ResponseWriter, r *http.Request) {
+	s.exportSource(w, r, s.goog, "google", &Response{Status: 401, Message: "Google: not logged in."})
+}
+
+// Responds with a zip archive of the playlists of src, or with
+// notLoggedIn if it isn't logged in
+func (s *Server) exportSource(w http.ResponseWriter, r *http.Request, src Source, name string, notLoggedIn *Response) {
+	var response *Response
+	if !src.LoggedIn() {
+		response = notLoggedIn
+	} else {
+		playlists := src.AllPlaylists()
+		var exported []ExportedPlaylist
+		var err error
+		if wanted := r.URL.Query().Get("playlists"); wanted != "" {
+			playlists, err = selectPlaylists(playlists, strings.Split(wanted, ","))
+		}
+		if err != nil {
+			response = &Response{Status: 404, Message: err.Error()}
+		} else if exported, err = exportPlaylists(src, playlists, nil); err != nil {
+			response = &Response{Status: 500, Message: err.Error()}
+		} else {
+			// Build the archive first, so a failure can still be reported
+			var buf bytes.Buffer
+			target := newZipExport(&buf)
+			err = writeExport(target, exported)
+			if err == nil {
+				err = target.Close()
+			}
+			if err != nil {
+				response = &Response{Status: 500, Message: fmt.Sprintf("Error writing export: %v", err)}
+			} else {
+				file := fmt.Sprintf("%s-%s.zip", name, time.Now().Format("20060102-150405"))
+				w.Header().Set("Content-Type", "application/zip")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+				w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+				w.Write(buf.Bytes())
+				return
+			}
+		}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
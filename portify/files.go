@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The name playlist files are registered under as a source
+const fileSourceName = "file"
+
+// Playlists read from files have URIs made of this prefix and their path
+const filePlaylistPrefix = "file:"
+
+// How much of an upload is kept in memory, the rest goes to temporary files
+const maxUploadMemory = 10 << 20
+
+// The largest upload accepted, and the largest playlist file in it
+const (
+	maxUploadSize       = 50 << 20
+	maxPlaylistFileSize = 5 << 20
+)
+
+// A Source reading playlists from M3U, XSPF and CSV files: the files it was
+// given, and those uploaded to its directory
+type FileSource struct {
+	dir   string
+	files []string
+}
+
+func newFileSource(dir string, files ...string) *FileSource {
+	return &FileSource{dir: dir, files: files}
+}
+
+// Playlist files are always there to be read
+func (s *FileSource) LoggedIn() bool {
+	return true
+}
+
+// Lists the files the source was given, then the uploaded ones in the
+// order they were uploaded
+func (s *FileSource) AllPlaylists() []Playlist {
+	files := append([]string{}, s.files...)
+	if s.dir != "" {
+		uploads, err := filepath.Glob(filepath.Join(s.dir, "*", "*"))
+		if err != nil {
+			fmt.Printf("Couldn't list uploaded playlists: %v\n", err)
+		}
+		files = append(files, uploads...)
+	}
+
+	playlists := []Playlist{}
+	for _, file := range files {
+		playlist, _, err := readPlaylistFile(file)
+		if err != nil {
+			fmt.Printf("Couldn't read playlist %s: %v\n", file, err)
+			continue
+		}
+		playlists = append(playlists, playlist)
+	}
+	return playlists
+}
+
+// Streams the tracks of a playlist file. An unreadable file has no tracks.
+func (s *FileSource) PlaylistTracks(playlist *Playlist, cancel <-chan struct{}) (chan BasicTrack, int) {
+	ret := make(chan BasicTrack)
+
+	file, err := s.path(playlist.Uri)
+	var tracks []BasicTrack
+	if err == nil {
+		_, tracks, err = readPlaylistFile(file)
+	}
+	if err != nil {
+		fmt.Printf("Couldn't read playlist '%s': %v\n", playlist.Name, err)
+		close(ret)
+		return ret, 0
+	}
+
+	go func() {
+		defer close(ret)
+		for _, track := range tracks {
+			select {
+			case ret <- track:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return ret, len(tracks)
+}
+
+// Keeps an uploaded playlist file, once it was checked it can be read
+func (s *FileSource) Upload(name string, r io.Reader) (Playlist, error) {
+	name = filepath.Base(name)
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxPlaylistFileSize+1))
+	if err != nil {
+		return Playlist{}, err
+	}
+	if len(content) > maxPlaylistFileSize {
+		return Playlist{}, fmt.Errorf("Playlist files can't be larger than %d MB", maxPlaylistFileSize>>20)
+	}
+	if _, err := parsePlaylistFile(name, bytes.NewReader(content)); err != nil {
+		return Playlist{}, err
+	}
+
+	// Every upload gets its own directory, named so they sort in the order
+	// they were uploaded
+	dir := filepath.Join(s.dir, fmt.Sprintf("%019d", time.Now().UnixNano()))
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return Playlist{}, err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return Playlist{}, err
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		return Playlist{}, err
+	}
+
+	playlist, _, err := readPlaylistFile(file)
+	return playlist, err
+}
+
+// Returns the file a playlist URI stands for, refusing files the source
+// wasn't given and that weren't uploaded
+func (s *FileSource) path(uri string) (string, error) {
+	if !strings.HasPrefix(uri, filePlaylistPrefix) {
+		return "", fmt.Errorf("Not a playlist file: %s", uri)
+	}
+	file := filepath.Clean(strings.TrimPrefix(uri, filePlaylistPrefix))
+	for _, f := range s.files {
+		if file == filepath.Clean(f) {
+			return file, nil
+		}
+	}
+	if s.dir != "" {
+		// Uploads are in a directory of their own in dir
+		if filepath.Dir(filepath.Dir(file)) == filepath.Clean(s.dir) {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown playlist file: %s", file)
+}
+
+// A playlist file's tracks, and the title it gives itself if any
+type playlistFile struct {
+	Title  string
+	Tracks []BasicTrack
+}
+
+// Reads a playlist file, naming the playlist after the file if it doesn't
+// have a title
+func readPlaylistFile(file string) (Playlist, []BasicTrack, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Playlist{}, nil, err
+	}
+	defer f.Close()
+
+	parsed, err := parsePlaylistFile(file, f)
+	if err != nil {
+		return Playlist{}, nil, err
+	}
+	name := parsed.Title
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return Playlist{Uri: filePlaylistPrefix + file, Name: name}, parsed.Tracks, nil
+}
+
+// Parses a playlist file, in the format its extension says
+func parsePlaylistFile(name string, r io.Reader) (*playlistFile, error) {
+	var parsed *playlistFile
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u", ".m3u8":
+		parsed, err = parseM3U(r)
+	case ".xspf":
+		parsed, err = parseXSPF(r)
+	case ".csv":
+		parsed, err = parseCSV(r)
+	default:
+		return nil, fmt.Errorf("Unsupported playlist file %s, use M3U, M3U8, XSPF or CSV", filepath.Base(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range parsed.Tracks {
+		parsed.Tracks[i] = fileTrack(parsed.Tracks[i], name, i)
+	}
+	return parsed, nil
+}
+
+// Parses an M3U or M3U8 playlist. Tracks are described by their #EXTINF
+// line, or by their file name if they don't have one.
+func parseM3U(r io.Reader) (*playlistFile, error) {
+	parsed := &playlistFile{}
+	var info *BasicTrack
+	album := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			track := parseExtinf(strings.TrimPrefix(line, "#EXTINF:"))
+			info = &track
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			parsed.Title = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#EXTALB:"):
+			album = strings.TrimSpace(strings.TrimPrefix(line, "#EXTALB:"))
+		case strings.HasPrefix(line, "#"):
+			// Other directives and comments
+		default:
+			var track BasicTrack
+			if info != nil && info.Title != "" {
+				track = *info
+			} else {
+				track = trackFromLocation(line)
+				if info != nil {
+					track.Duration = info.Duration
+				}
+			}
+			if track.Album == "" {
+				track.Album = album
+			}
+			parsed.Tracks = append(parsed.Tracks, track)
+			info = nil
+			album = ""
+		}
+	}
+	return parsed, scanner.Err()
+}
+
+// Parses what follows #EXTINF:, like "215,Artist - Title". Attributes some
+// players put after the duration are ignored.
+func parseExtinf(text string) BasicTrack {
+	var track BasicTrack
+	p := strings.SplitN(text, ",", 2)
+	if fields := strings.Fields(p[0]); len(fields) > 0 {
+		if seconds, err := strconv.Atoi(fields[0]); err == nil && seconds > 0 {
+			track.Duration = time.Duration(seconds) * time.Second
+		}
+	}
+	if len(p) == 2 {
+		artist, title := splitArtistTitle(p[1])
+		track.Title = title
+		if artist != "" {
+			track.Artists = []string{artist}
+		}
+	}
+	return track
+}
+
+// Guesses a track from its file name, like "Artist - Title.mp3"
+func trackFromLocation(location string) BasicTrack {
+	if strings.Contains(location, "://") {
+		if u, err := url.Parse(location); err == nil {
+			location = u.Path
+		}
+	}
+	name := path.Base(strings.Replace(location, `\`, "/", -1))
+	name = strings.TrimSuffix(name, path.Ext(name))
+
+	var track BasicTrack
+	artist, title := splitArtistTitle(name)
+	track.Title = title
+	if artist != "" {
+		track.Artists = []string{artist}
+	}
+	return track
+}
+
+// Splits "Artist - Title"; text without a separator is all title
+func splitArtistTitle(text string) (string, string) {
+	p := strings.SplitN(text, " - ", 2)
+	if len(p) == 2 {
+		return strings.TrimSpace(p[0]), strings.TrimSpace(p[1])
+	}
+	return "", strings.TrimSpace(text)
+}
+
+// The namespace of XSPF playlists
+const xspfNamespace = "http://xspf.org/ns/0/"
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location,omitempty"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // In milliseconds
+	TrackNum int    `xml:"trackNum,omitempty"`
+}
+
+// Parses an XSPF playlist. Tracks without a title are guessed from their
+// location.
+func parseXSPF(r io.Reader) (*playlistFile, error) {
+	var playlist xspfPlaylist
+	if err := xml.NewDecoder(r).Decode(&playlist); err != nil {
+		return nil, fmt.Errorf("Invalid XSPF: %v", err)
+	}
+
+	parsed := &playlistFile{Title: strings.TrimSpace(playlist.Title)}
+	for _, t := range playlist.Tracks {
+		var track BasicTrack
+		if strings.TrimSpace(t.Title) == "" {
+			track = trackFromLocation(strings.TrimSpace(t.Location))
+		} else {
+			track.Title = strings.TrimSpace(t.Title)
+			if creator := strings.TrimSpace(t.Creator); creator != "" {
+				track.Artists = []string{creator}
+			}
+		}
+		track.Album = strings.TrimSpace(t.Album)
+		track.Duration = time.Duration(t.Duration) * time.Millisecond
+		track.Index = t.TrackNum
+		parsed.Tracks = append(parsed.Tracks, track)
+	}
+	return parsed, nil
+}
+
+// Parses a CSV playlist, one track per row as artist, title, album and
+// duration. The album and duration can be left out, and a header row is
+// skipped.
+func parseCSV(r io.Reader) (*playlistFile, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+
+	parsed := &playlistFile{}
+	for row := 1; ; row++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid CSV: %v", err)
+		}
+		if row == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(record[0], "\ufeff")), "artist") {
+			continue
+		}
+		if len(record) < 2 || strings.TrimSpace(record[1]) == "" {
+			return nil, fmt.Errorf("Row %d of the CSV has no title", row)
+		}
+
+		var track BasicTrack
+		if artist := strings.TrimSpace(record[0]); artist != "" {
+			track.Artists = []string{artist}
+		}
+		track.Title = strings.TrimSpace(record[1])
+		if len(record) > 2 {
+			track.Album = strings.TrimSpace(record[2])
+		}
+		if len(record) > 3 && strings.TrimSpace(record[3]) != "" {
+			track.Duration, err = parseTrackDuration(strings.TrimSpace(record[3]))
+			if err != nil {
+				return nil, fmt.Errorf("Row %d of the CSV has an invalid duration: %v", row, err)
+			}
+		}
+		parsed.Tracks = append(parsed.Tracks, track)
+	}
+	return parsed, nil
+}
+
+// Parses a duration written as seconds, "m:ss" or "h:mm:ss"
+func parseTrackDuration(text string) (time.Duration, error) {
+	var seconds float64
+	for _, part := range strings.Split(text, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q", text)
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Completes the track at a position of a playlist file the way Spotify
+// tracks are. As there is nothing else to tell tracks apart, their URI is
+// made of their metadata, so the same track in different files shares its
+// cached match. Tracks without both a title and an artist could be anything,
+// so they are only known by where they are in the file.
+func fileTrack(track BasicTrack, file string, position int) BasicTrack {
+	track.Name = track.Title
+	artist := ""
+	if len(track.Artists) > 0 {
+		artist = track.Artists[0]
+		track.Name = fmt.Sprintf("%s - %s", artist, track.Title)
+	}
+	if artist == "" || track.Title == "" {
+		track.Uri = fmt.Sprintf("file:entry:%s:%d", url.QueryEscape(file), position+1)
+	} else {
+		track.Uri = fmt.Sprintf("file:track:%s:%s:%s", url.QueryEscape(artist), url.QueryEscape(track.Title), url.QueryEscape(track.Album))
+	}
+	track.Available = true
+	return track
+}
+
+// Serves GET /portify/files, which lists the uploaded playlist files, and
+// POST /portify/files, which uploads the files of a multipart form
+func (s *Server) playlistFiles(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		response = s.uploadPlaylistFiles(r)
+	} else {
+		response = &Response{Status: 200, Message: "ok", Data: s.files.AllPlaylists()}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (s *Server) uploadPlaylistFiles(r *http.Request) *Response {
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return &Response{Status: 400, Message: fmt.Sprintf("Invalid upload: %v", err)}
+	}
+	uploads := r.MultipartForm.File["files"]
+	if len(uploads) == 0 {
+		return &Response{Status: 400, Message: "Please select at least one playlist file."}
+	}
+
+	playlists := []Playlist{}
+	for _, upload := range uploads {
+		f, err := upload.Open()
+		if err != nil {
+			return &Response{Status: 500, Message: err.Error()}
+		}
+		playlist, err := s.files.Upload(upload.Filename, f)
+		f.Close()
+		if err != nil {
+			return &Response{Status: 400, Message: fmt.Sprintf("Couldn't read '%s': %v", upload.Filename, err)}
+		}
+		playlists = append(playlists, playlist)
+	}
+	return &Response{Status: 200, Message: fmt.Sprintf("%d playlists uploaded.", len(playlists)), Data: playlists}
+}
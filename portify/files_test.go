@@ -0,0 +1,249 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The parts of a parsed track the tests look at
+type parsedTrack struct {
+	Artists  []string
+	Title    string
+	Album    string
+	Duration time.Duration
+}
+
+func parsedTracks(tracks []BasicTrack) []parsedTrack {
+	parsed := []parsedTrack{}
+	for _, t := range tracks {
+		parsed = append(parsed, parsedTrack{t.Artists, t.Title, t.Album, t.Duration})
+	}
+	return parsed
+}
+
+func TestParseM3U(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		title  string
+		tracks []parsedTrack
+	}{
+		{
+			name: "extended",
+			input: "#EXTM3U\n#PLAYLIST:Road Trip\n" +
+				"#EXTINF:215,Artist - Title\n#EXTALB:Album\n/music/a.mp3\n" +
+				"#EXTINF:-1,Other - Stream\nhttp://example.com/stream\n",
+			title: "Road Trip",
+			tracks: []parsedTrack{
+				{[]string{"Artist"}, "Title", "Album", 215 * time.Second},
+				{[]string{"Other"}, "Stream", "", 0},
+			},
+		},
+		{
+			name:  "byte order mark and windows line endings",
+			input: "\ufeff#EXTM3U\r\n#EXTINF:100,Artist - Title\r\nC:\\Music\\a.mp3\r\n",
+			tracks: []parsedTrack{
+				{[]string{"Artist"}, "Title", "", 100 * time.Second},
+			},
+		},
+		{
+			name:  "file names only",
+			input: "Artist - Title.mp3\n\n# a comment\nmusic/Only Title.flac\nhttp://example.com/Some%20One%20-%20Song.mp3\n",
+			tracks: []parsedTrack{
+				{[]string{"Artist"}, "Title", "", 0},
+				{nil, "Only Title", "", 0},
+				{[]string{"Some One"}, "Song", "", 0},
+			},
+		},
+		{
+			name:  "extinf without a title",
+			input: "#EXTINF:180,\nArtist - Title.mp3\n",
+			tracks: []parsedTrack{
+				{[]string{"Artist"}, "Title", "", 180 * time.Second},
+			},
+		},
+		{
+			name:   "empty",
+			input:  "#EXTM3U\n",
+			tracks: []parsedTrack{},
+		},
+	}
+	for _, test := range tests {
+		parsed, err := parseM3U(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if parsed.Title != test.title {
+			t.Errorf("%s: title %q, want %q", test.name, parsed.Title, test.title)
+		}
+		if got := parsedTracks(parsed.Tracks); !reflect.DeepEqual(got, test.tracks) {
+			t.Errorf("%s: tracks %+v, want %+v", test.name, got, test.tracks)
+		}
+	}
+}
+
+func TestParseExtinf(t *testing.T) {
+	tests := []struct {
+		input string
+		want  parsedTrack
+	}{
+		{"215,Artist - Title", parsedTrack{[]string{"Artist"}, "Title", "", 215 * time.Second}},
+		{"-1,Artist - Title", parsedTrack{[]string{"Artist"}, "Title", "", 0}},
+		{"0,Title Only", parsedTrack{nil, "Title Only", "", 0}},
+		{`215 tvg-id="x" group-title="y",Artist - A, B - C`, parsedTrack{[]string{"Artist"}, "A, B - C", "", 215 * time.Second}},
+		{"abc,Artist - Title", parsedTrack{[]string{"Artist"}, "Title", "", 0}},
+		{"215", parsedTrack{nil, "", "", 215 * time.Second}},
+	}
+	for _, test := range tests {
+		track := parseExtinf(test.input)
+		if got := (parsedTrack{track.Artists, track.Title, track.Album, track.Duration}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseExtinf(%q) = %+v, want %+v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseXSPF(t *testing.T) {
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <title> Mix </title>
+  <trackList>
+    <track>
+      <location>file:///music/a.mp3</location>
+      <title>Title</title>
+      <creator>Artist</creator>
+      <album>Album</album>
+      <duration>215000</duration>
+      <trackNum>3</trackNum>
+    </track>
+    <track>
+      <location>file:///music/Other%20-%20Song.ogg</location>
+    </track>
+    <track>
+      <title>No Creator</title>
+    </track>
+  </trackList>
+</playlist>`
+	parsed, err := parseXSPF(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Title != "Mix" {
+		t.Errorf("title %q, want %q", parsed.Title, "Mix")
+	}
+	want := []parsedTrack{
+		{[]string{"Artist"}, "Title", "Album", 215 * time.Second},
+		{[]string{"Other"}, "Song", "", 0},
+		{nil, "No Creator", "", 0},
+	}
+	if got := parsedTracks(parsed.Tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("tracks %+v, want %+v", got, want)
+	}
+	if parsed.Tracks[0].Index != 3 {
+		t.Errorf("track number %d, want 3", parsed.Tracks[0].Index)
+	}
+
+	if _, err := parseXSPF(strings.NewReader("<playlist><trackList>")); err == nil {
+		t.Errorf("parsing truncated XSPF succeeded")
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		tracks []parsedTrack
+		err    bool
+	}{
+		{
+			name:  "header row",
+			input: "\ufeffArtist,Title,Album,Duration\nA,T,Al,3:05\n",
+			tracks: []parsedTrack{
+				{[]string{"A"}, "T", "Al", 185 * time.Second},
+			},
+		},
+		{
+			name:  "missing columns",
+			input: "A,T\nB, U, Al\n, V,,\n",
+			tracks: []parsedTrack{
+				{[]string{"A"}, "T", "", 0},
+				{[]string{"B"}, "U", "Al", 0},
+				{nil, "V", "", 0},
+			},
+		},
+		{
+			name:  "quoted fields",
+			input: `"Simon, Paul","Title ""Live""",Album,200` + "\n",
+			tracks: []parsedTrack{
+				{[]string{"Simon, Paul"}, `Title "Live"`, "Album", 200 * time.Second},
+			},
+		},
+		{name: "no title", input: "A\n", err: true},
+		{name: "empty title", input: "A,,Album\n", err: true},
+		{name: "invalid duration", input: "A,T,Al,soon\n", err: true},
+	}
+	for _, test := range tests {
+		parsed, err := parseCSV(strings.NewReader(test.input))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: parsing succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := parsedTracks(parsed.Tracks); !reflect.DeepEqual(got, test.tracks) {
+			t.Errorf("%s: tracks %+v, want %+v", test.name, got, test.tracks)
+		}
+	}
+}
+
+func TestParseTrackDuration(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+		err   bool
+	}{
+		{"215", 215 * time.Second, false},
+		{"3:35", 215 * time.Second, false},
+		{"03:05", 185 * time.Second, false},
+		{"1:02:03", time.Hour + 2*time.Minute + 3*time.Second, false},
+		{"215.5", 215500 * time.Millisecond, false},
+		{"", 0, true},
+		{"3:", 0, true},
+		{"-3", 0, true},
+		{"three", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseTrackDuration(test.input)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("parseTrackDuration(%q) = %v, %v, want %v, error %v", test.input, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestFileTrackUris(t *testing.T) {
+	input := `<playlist version="1" xmlns="http://xspf.org/ns/0/"><trackList>
+<track><duration>1000</duration></track>
+<track><duration>2000</duration></track>
+<track><title>Title</title><creator>Artist</creator></track>
+</trackList></playlist>`
+	parsed, err := parsePlaylistFile("/music/mix.xspf", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"file:entry:%2Fmusic%2Fmix.xspf:1",
+		"file:entry:%2Fmusic%2Fmix.xspf:2",
+		"file:track:Artist:Title:",
+	}
+	for i, uri := range want {
+		if parsed.Tracks[i].Uri != uri {
+			t.Errorf("track %d has URI %q, want %q", i, parsed.Tracks[i].Uri, uri)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// The default template for the name of a destination playlist, which puts
+// the folders it is in before its name, like "Work / Focus / Deep"
+const defaultPlaylistNameTemplate = `{{range .Folders}}{{.}} / {{end}}{{.Name}}`
+
+// A folder of playlists, as shown by the playlists API
+type PlaylistFolder struct {
+	Name      string            `json:"name"`
+	Folders   []*PlaylistFolder `json:"folders"`
+	Playlists []Playlist        `json:"playlists"`
+}
+
+// Arranges playlists in the tree of folders they are in, keeping their order
+func playlistTree(playlists []Playlist) *PlaylistFolder {
+	root := &PlaylistFolder{Folders: []*PlaylistFolder{}, Playlists: []Playlist{}}
+	for _, p := range playlists {
+		folder := root
+		for _, name := range p.Folders {
+			folder = folder.subfolder(name)
+		}
+		folder.Playlists = append(folder.Playlists, p)
+	}
+	return root
+}
+
+// Returns the subfolder with the given name, adding it if needed
+func (f *PlaylistFolder) subfolder(name string) *PlaylistFolder {
+	for _, sub := range f.Folders {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	sub := &PlaylistFolder{Name: name, Folders: []*PlaylistFolder{}, Playlists: []Playlist{}}
+	f.Folders = append(f.Folders, sub)
+	return sub
+}
+
+// Parses a template for destination playlist names. It is given the source
+// Playlist, so it can use .Name and .Folders.
+func parsePlaylistNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("playlist name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid playlist name template: %v", err)
+	}
+	if _, err := destinationName(tmpl, Playlist{Name: "Deep", Folders: []string{"Work", "Focus"}}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Names the destination copy of a playlist. Without a template, or if it
+// renders empty, the playlist keeps its own name.
+func destinationName(tmpl *template.Template, p Playlist) (string, error) {
+	if tmpl == nil {
+		return p.Name, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return "", fmt.Errorf("Invalid playlist name template: %v", err)
+	}
+	name := strings.TrimSpace(buf.String())
+	if name == "" {
+		return p.Name, nil
+	}
+	return name, nil
+}
@@ -1,79 +1,139 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const SJURL = "https://mclients.googleapis.com/sj/v1.10/"
-const LOGINURL = "https://www.google.com/accounts/ClientLogin"
+
+// How the catalog marks explicit tracks and their clean versions
+const (
+	explicitTypeExplicit = "1"
+	explicitTypeClean    = "2"
+)
+
+// The rating Google Music gives a track with a thumbs up
+const thumbsUpRating = "5"
+
+// Google playlists and tracks read as a source have URIs made of these
+// prefixes and their id
+const (
+	googlePlaylistPrefix = "google:playlist:"
+	googleTrackPrefix    = "google:track:"
+)
+
+// How many items are requested per page of a feed
+const feedPageSize = 1000
+
+// How many playlist entries are created per request
+const mutationBatchSize = 100
+
+// Retrying of throttled and failed requests
+const (
+	maxRetries  = 5
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
 
 type Google struct {
-	client *http.Client
-	auth   string
+	client    *http.Client
+	transport *http.Transport
+	auth      *googleAuth
+	limiter   *rateLimiter
+
+	// The playlist entries and library read as a source, fetched once for
+	// all the playlists of a transfer or export
+	feedMu   sync.Mutex
+	snapshot *librarySnapshot
+}
+
+// The feeds a source reads every playlist out of
+type librarySnapshot struct {
+	// The entries of every playlist by playlist id, in playlist order
+	entries map[string][]PlaylistEntry
+	// The tracks of the library by id, nil until a playlist needs them
+	library map[string]LibraryTrack
 }
 
 // A subset of the SearchResult track containing only the data we need
 type RelevantTrack struct {
-	Nid    string
-	Artist string
-	Title  string
+	Nid        string
+	Artist     string
+	Title      string
+	Album      string
+	Confidence float64
+	Karaoke    bool
+}
+
+func NewGoogle(endpoints AuthEndpoints) *Google {
+	// Keep hold of the transport to be able to cancel requests in flight
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	client := &http.Client{Transport: transport}
+	limiter := newRateLimiter(defaultSettings.GoogleRequestsPerSecond, defaultSettings.GoogleBurst)
+	return &Google{client: client, transport: transport, auth: newGoogleAuth(endpoints, client), limiter: limiter}
 }
 
-func NewGoogle() *Google {
-	client := &http.Client{}
-	return &Google{client: client}
+// Limits the requests sent to Google by every transfer together
+func (g *Google) SetRateLimit(requestsPerSecond float64, burst int) {
+	g.limiter.SetLimit(requestsPerSecond, burst)
 }
 
 func (g *Google) LoggedIn() bool {
-	return g.auth != ""
+	return g.auth.loggedIn()
 }
 
+// Logs in with an app-specific password, replacing the retired ClientLogin
 func (g *Google) Login(email string, password string) error {
+	return g.auth.loginAppPassword(email, password)
+}
 
-	resp, err := g.client.PostForm(LOGINURL,
-		url.Values{
-			"Email":       {email},
-			"Passwd":      {password},
-			"accountType": {"HOSTED_OR_GOOGLE"},
-			"source":      {"goportify"},
-			"service":     {"sj"},
-		})
+// Starts a login on another device, see googleAuth.requestDeviceCode
+func (g *Google) RequestDeviceCode() (*DeviceCode, error) {
+	return g.auth.requestDeviceCode()
+}
 
-	if err != nil {
-		return fmt.Errorf("HTTP Error logging in: %s", err)
-	}
-	if resp.StatusCode == 403 {
-		return fmt.Errorf("Couldn't login")
-	}
+// Waits for the user to enter a device code and logs in
+func (g *Google) WaitForDeviceLogin(code *DeviceCode, cancel <-chan struct{}) error {
+	return g.auth.pollDeviceToken(code, cancel)
+}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("Error reading login body: %s", err)
-	}
+// Returns where to send the user to log in with their browser
+func (g *Google) AuthCodeURL(redirectURL string) (string, error) {
+	return g.auth.authCodeURL(redirectURL)
+}
 
-	authResponse, err := parseAuthResponse(string(body))
-	if err != nil {
-		return fmt.Errorf("Error parsing auth response: %s", err)
-	}
-	if authResponse["Auth"] == "" {
-		return fmt.Errorf("Didn't receive an auth response")
-	}
+// Finishes a browser login
+func (g *Google) ExchangeCode(code string, state string, redirectURL string) error {
+	return g.auth.exchangeCode(code, state, redirectURL)
+}
 
-	g.auth = authResponse["Auth"]
+// Keeps the login in store between runs, restoring the one saved before
+func (g *Google) PersistLogin(store *tokenStore) error {
+	return g.auth.useStore(store)
+}
 
-	return nil
+// Forgets the login, including the saved one
+func (g *Google) Logout() error {
+	return g.auth.setToken(nil)
 }
 
-func (g *Google) Search(query string, maxResults int) (*SearchResult, error) {
+// Searches the catalog. The search is abandoned as soon as cancel is closed.
+func (g *Google) Search(query string, maxResults int, cancel <-chan struct{}) (*SearchResult, error) {
 	url := fmt.Sprintf("%squery?q=%s&max-items=%d", SJURL, url.QueryEscape(query), maxResults)
 	// url := SJURL + "query?q=Katy%20perry&max-items=2"
-	body, err := g.execute("GET", url, nil)
+	body, err := g.execute("GET", url, nil, cancel)
 	if err != nil {
 		return nil, err
 	}
@@ -86,31 +146,85 @@ func (g *Google) Search(query string, maxResults int) (*SearchResult, error) {
 	return &result, nil
 }
 
-func (g *Google) FindBestTrack(query string) (*RelevantTrack, error) {
-	sResult, err := g.Search(query, 2)
+func (g *Google) FindBestTrack(track BasicTrack, cancel <-chan struct{}) (*RelevantTrack, error) {
+	query := newTrackQuery(track)
+	ranked, err := g.Candidates(query, query.searchString(), cancel)
 	if err != nil {
+		return nil, err
+	}
+	// Karaoke and cover versions are only good enough for tracks that are
+	// one themselves
+	var best *scoredCandidate
+	filtered := false
+	for i := range ranked {
+		if ranked[i].Karaoke && !query.Karaoke {
+			filtered = filtered || ranked[i].Confidence/karaokePenalty >= minMatchConfidence
+			continue
+		}
+		best = &ranked[i]
+		break
+	}
+	if best == nil || best.Confidence < minMatchConfidence {
+		if filtered {
+			return nil, &KaraokeOnlyError{Track: track.Name}
+		}
+		return nil, fmt.Errorf("No tracks for %s", track.Name)
+	}
+
+	return &RelevantTrack{
+		Nid:        best.Nid,
+		Artist:     best.Artist,
+		Title:      best.Title,
+		Album:      best.Album,
+		Confidence: best.Confidence,
+		Karaoke:    best.Karaoke,
+	}, nil
+}
+
+// Searches the catalog for the given text, returning the tracks found
+// ranked from best to worst match for the query
+func (g *Google) Candidates(query trackQuery, search string, cancel <-chan struct{}) ([]scoredCandidate, error) {
+	sResult, err := g.Search(search, matchCandidates, cancel)
+	if isServiceError(err) || err == errCancelled {
+		return nil, err
+	} else if err != nil {
 		return nil, fmt.Errorf("Couldn't execute search: %s\n", err)
 	}
+	return rankCandidates(query, searchCandidates(sResult)), nil
+}
 
+// Extracts the tracks out of a search result
+func searchCandidates(sResult *SearchResult) []MatchCandidate {
+	candidates := []MatchCandidate{}
 	for _, entry := range sResult.Entries {
 		// Filter only tracks
-		if entry.Type == "1" {
-			return &RelevantTrack{
-				Nid:    entry.Track.Nid,
-				Artist: entry.Track.Artist,
-				Title:  entry.Track.Title,
-			}, nil
+		if entry.Type != "1" {
+			continue
 		}
+		millis, _ := strconv.ParseInt(entry.Track.DurationMillis, 10, 64)
+		candidates = append(candidates, MatchCandidate{
+			Nid:        entry.Track.Nid,
+			Artist:     entry.Track.Artist,
+			Title:      entry.Track.Title,
+			Album:      entry.Track.Album,
+			Duration:   time.Duration(millis) * time.Millisecond,
+			BestResult: entry.BestResult,
+			Score:      entry.Score,
+			Explicit:   entry.Track.ExplicitType == explicitTypeExplicit,
+			Clean:      entry.Track.ExplicitType == explicitTypeClean,
+		})
 	}
-	return nil, fmt.Errorf("No tracks for %s", query)
+	return candidates
 }
 
 func (g *Google) CreatePlaylist(name string, public bool) (string, error) {
 	mutations := buildCreatePlaylist(name, public)
 	content := &DataPlaylistItem{mutations}
 
-	body, err := g.execute("POST", SJURL+"playlistbatch?alt=json", content)
-	if err != nil {
+	body, err := g.mutate(SJURL+"playlistbatch?alt=json", content)
+	if isServiceError(err) {
+		return "", err
+	} else if err != nil {
 		return "", fmt.Errorf("Couldn't execute playlistbatch: %v", err)
 	}
 
@@ -119,57 +233,580 @@ func (g *Google) CreatePlaylist(name string, public bool) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Unable to unmarshal json: %v", err)
 	}
+	if len(response.MutateResponse) == 0 || response.MutateResponse[0].ResponseCode != "OK" {
+		return "", fmt.Errorf("Playlist creation was rejected: %s", body)
+	}
 	return response.MutateResponse[0].ID, nil
 	// return res['mutate_response'][0]['id']
 }
 
-func (g *Google) AddTracks(playlistId string, songIds []string) error {
+// Appends tracks to a playlist, in batches of at most mutationBatchSize
+// entries. When some entries are rejected, the others are still added and a
+// *MutationError lists the rejected ones.
+func (g *Google) AddTracks(playlistId string, songIds []string, batchDone batchFunc) error {
+	return g.createEntries(buildAddTracks(playlistId, songIds...), batchDone)
+}
+
+// Inserts tracks into a playlist between two of its entries. An empty
+// precedingEntryId inserts right before followingEntryId, an empty
+// followingEntryId right after precedingEntryId; with neither, the tracks
+// are appended like AddTracks does.
+func (g *Google) InsertTracks(playlistId string, songIds []string, precedingEntryId string, followingEntryId string) error {
 	mutations := buildAddTracks(playlistId, songIds...)
-	content := &DataTrackItem{mutations}
+	if len(mutations) == 0 {
+		return nil
+	}
+	mutations[0].Create.PrecedingEntryId = precedingEntryId
+	mutations[len(mutations)-1].Create.FollowingEntryId = followingEntryId
+	return g.createEntries(mutations, nil)
+}
+
+// Sends playlist entry creations, in batches of at most mutationBatchSize
+func (g *Google) createEntries(mutations []MutationTrackItem, batchDone batchFunc) error {
+	failures := []MutationFailure{}
 
-	_, err := g.execute("POST", SJURL+"plentriesbatch?alt=json", content)
+	// Entries link to their neighbours by client id, which only works within
+	// a batch. The last entry of a batch links to nothing, as the next batch
+	// doesn't exist yet, and the first entry of the next one links to the
+	// last entry that was created.
+	lastId := ""
+	if len(mutations) > 0 {
+		lastId = mutations[0].Create.PrecedingEntryId
+	}
+	for start := 0; start < len(mutations); start += mutationBatchSize {
+		end := start + mutationBatchSize
+		if end > len(mutations) {
+			end = len(mutations)
+		}
+		batch := mutations[start:end]
+		batch[0].Create.PrecedingEntryId = lastId
+		if end < len(mutations) {
+			batch[len(batch)-1].Create.FollowingEntryId = ""
+		}
+
+		body, err := g.mutate(SJURL+"plentriesbatch?alt=json", &DataTrackItem{batch})
+		if isServiceError(err) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Couldn't execute http query: %v", err)
+		}
+
+		var response MutateResponseContainer
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return fmt.Errorf("Unable to unmarshal json: %v", err)
+		}
+
+		rejected := []MutationFailure{}
+		for i, mutation := range batch {
+			if i >= len(response.MutateResponse) {
+				rejected = append(rejected, MutationFailure{TrackId: mutation.Create.TrackId, ResponseCode: "MISSING"})
+				continue
+			}
+			result := response.MutateResponse[i]
+			if result.ResponseCode != "OK" {
+				rejected = append(rejected, MutationFailure{TrackId: mutation.Create.TrackId, ResponseCode: result.ResponseCode})
+				continue
+			}
+			lastId = result.ID
+		}
+		failures = append(failures, rejected...)
+		if batchDone != nil {
+			if err := batchDone(end, rejected); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return &MutationError{Service: "Google", Failures: failures}
+	}
+	return nil
+}
+
+// Gives catalog tracks a thumbs up, optionally adding them to the library.
+// Like AddTracks, rejected tracks are listed in a *MutationError.
+func (g *Google) ThumbsUp(tracks []RelevantTrack, addToLibrary bool) error {
+	mutations := buildRateTracks(tracks, thumbsUpRating, addToLibrary)
+	failures := []MutationFailure{}
+
+	for start := 0; start < len(mutations); start += mutationBatchSize {
+		end := start + mutationBatchSize
+		if end > len(mutations) {
+			end = len(mutations)
+		}
+		batch := mutations[start:end]
+
+		body, err := g.mutate(SJURL+"trackbatch?alt=json", &DataTrackMetadataItem{batch})
+		if isServiceError(err) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Couldn't execute trackbatch: %v", err)
+		}
+
+		var response MutateResponseContainer
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return fmt.Errorf("Unable to unmarshal json: %v", err)
+		}
+
+		for i := range batch {
+			trackId := tracks[start+i].Nid
+			if i >= len(response.MutateResponse) {
+				failures = append(failures, MutationFailure{TrackId: trackId, ResponseCode: "MISSING"})
+			} else if code := response.MutateResponse[i].ResponseCode; code != "OK" {
+				failures = append(failures, MutationFailure{TrackId: trackId, ResponseCode: code})
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return &MutationError{Service: "Google", Failures: failures}
+	}
+	return nil
+}
+
+// Returns the entries of a playlist, in playlist order. Entries of library
+// tracks have the id of the library track, so their catalog id is looked up
+// in the library to compare them with the tracks matched in the catalog.
+func (g *Google) PlaylistEntries(playlistId string) ([]PlaylistEntry, error) {
+	entries, err := g.playlistEntries(playlistId, nil)
 	if err != nil {
+		return nil, err
+	}
+
+	var library map[string]LibraryTrack
+	for i := range entries {
+		entry := &entries[i]
+		if strings.HasPrefix(entry.TrackId, "T") {
+			entry.StoreId = entry.TrackId
+			continue
+		}
+		if library == nil {
+			if library, err = g.libraryTracks(nil); err != nil {
+				return nil, err
+			}
+		}
+		track := library[entry.TrackId]
+		entry.StoreId = track.StoreId
+		if entry.StoreId == "" {
+			entry.StoreId = track.Nid
+		}
+	}
+	return entries, nil
+}
+
+func (g *Google) playlistEntries(playlistId string, cancel <-chan struct{}) ([]PlaylistEntry, error) {
+	entries, err := g.allPlaylistEntries(cancel)
+	if err != nil {
+		return nil, err
+	}
+	if entries[playlistId] == nil {
+		return []PlaylistEntry{}, nil
+	}
+	return entries[playlistId], nil
+}
+
+// Returns the entries of every playlist by playlist id, in playlist order.
+// The feed holds them all, so there's no reading a single playlist.
+func (g *Google) allPlaylistEntries(cancel <-chan struct{}) (map[string][]PlaylistEntry, error) {
+	entries := make(map[string][]PlaylistEntry)
+	err := g.fetchFeed("plentryfeed", cancel, func(body []byte) (string, error) {
+		var feed PlaylistEntryFeed
+		if err := json.Unmarshal(body, &feed); err != nil {
+			return "", err
+		}
+		for _, entry := range feed.Data.Items {
+			if !entry.Deleted {
+				entries[entry.PlaylistId] = append(entries[entry.PlaylistId], entry)
+			}
+		}
+		return feed.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, playlist := range entries {
+		sort.Sort(byAbsolutePosition(playlist))
+	}
+	return entries, nil
+}
+
+// Returns the playlists of the user
+func (g *Google) Playlists() ([]GooglePlaylist, error) {
+	playlists := []GooglePlaylist{}
+	err := g.fetchFeed("playlistfeed", nil, func(body []byte) (string, error) {
+		var feed PlaylistFeed
+		if err := json.Unmarshal(body, &feed); err != nil {
+			return "", err
+		}
+		for _, playlist := range feed.Data.Items {
+			if !playlist.Deleted {
+				playlists = append(playlists, playlist)
+			}
+		}
+		return feed.NextPageToken, nil
+	})
+	return playlists, err
+}
+
+// Returns the tracks of the user's library by their id
+func (g *Google) libraryTracks(cancel <-chan struct{}) (map[string]LibraryTrack, error) {
+	tracks := make(map[string]LibraryTrack)
+	err := g.fetchFeed("trackfeed", cancel, func(body []byte) (string, error) {
+		var feed TrackFeed
+		if err := json.Unmarshal(body, &feed); err != nil {
+			return "", err
+		}
+		for _, track := range feed.Data.Items {
+			if !track.Deleted {
+				tracks[track.Id] = track
+			}
+		}
+		return feed.NextPageToken, nil
+	})
+	return tracks, err
+}
+
+// Fetches every page of a feed, handing each to page, which returns the
+// token of the next page or "" after the last one
+func (g *Google) fetchFeed(name string, cancel <-chan struct{}, page func(body []byte) (string, error)) error {
+	token := ""
+	for {
+		content := &FeedRequest{MaxResults: strconv.Itoa(feedPageSize), StartToken: token}
+		body, err := g.execute("POST", SJURL+name+"?alt=json", content, cancel)
+		if isServiceError(err) || err == errCancelled {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Couldn't fetch %s: %v", name, err)
+		}
+
+		token, err = page(body)
+		if err != nil {
+			return fmt.Errorf("Unable to unmarshal json: %v", err)
+		}
+		if token == "" {
+			return nil
+		}
+	}
+}
+
+// Lists the playlists of the user, to use Google as a source. Their tracks
+// are read afresh after every listing, once for all of them.
+func (g *Google) AllPlaylists() []Playlist {
+	googlePlaylists, err := g.Playlists()
+	if err != nil {
+		fmt.Printf("Couldn't get Google playlists: %v\n", err)
+	}
+	g.feedMu.Lock()
+	g.snapshot = nil
+	g.feedMu.Unlock()
+	playlists := []Playlist{}
+	for _, p := range googlePlaylists {
+		playlists = append(playlists, p.playlist())
+	}
+	return playlists
+}
+
+// The playlist as other sources describe theirs
+func (p GooglePlaylist) playlist() Playlist {
+	return Playlist{Uri: googlePlaylistPrefix + p.Id, Name: p.Name}
+}
+
+// Streams the tracks of a playlist, looking up the library tracks in it.
+// A playlist that can't be read has no tracks.
+func (g *Google) PlaylistTracks(playlist *Playlist, cancel <-chan struct{}) (chan BasicTrack, int) {
+	ret := make(chan BasicTrack)
+
+	tracks, err := g.playlistTracks(strings.TrimPrefix(playlist.Uri, googlePlaylistPrefix), cancel)
+	if err != nil {
+		fmt.Printf("Couldn't get the tracks of '%s': %v\n", playlist.Name, err)
+		close(ret)
+		return ret, 0
+	}
+
+	go func() {
+		defer close(ret)
+		for _, track := range tracks {
+			select {
+			case ret <- track:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return ret, len(tracks)
+}
+
+func (g *Google) playlistTracks(playlistId string, cancel <-chan struct{}) ([]BasicTrack, error) {
+	// Playlists are read one after the other, waiting on each other here
+	// saves fetching the feeds twice
+	g.feedMu.Lock()
+	defer g.feedMu.Unlock()
+	if g.snapshot == nil {
+		entries, err := g.allPlaylistEntries(cancel)
+		if err != nil {
+			return nil, err
+		}
+		g.snapshot = &librarySnapshot{entries: entries}
+	}
+	entries := g.snapshot.entries[playlistId]
+
+	// Only fetch the library if the playlist has tracks from it
+	for _, entry := range entries {
+		if entry.Track == nil && g.snapshot.library == nil {
+			library, err := g.libraryTracks(cancel)
+			if err != nil {
+				return nil, err
+			}
+			g.snapshot.library = library
+			break
+		}
+	}
+	library := g.snapshot.library
+
+	tracks := []BasicTrack{}
+	for _, entry := range entries {
+		track := entry.Track
+		if track == nil {
+			t, ok := library[entry.TrackId]
+			if !ok {
+				fmt.Printf("Track %s of playlist %s isn't in the library anymore\n", entry.TrackId, playlistId)
+				continue
+			}
+			track = &t
+		}
+		tracks = append(tracks, libraryBasicTrack(entry.TrackId, track))
+	}
+	return tracks, nil
+}
+
+// Turns a Google track into the track model shared by every source
+func libraryBasicTrack(trackId string, track *LibraryTrack) BasicTrack {
+	basic := BasicTrack{
+		Uri:         googleTrackPrefix + trackId,
+		Name:        track.Title,
+		Title:       track.Title,
+		Album:       track.Album,
+		AlbumArtist: track.AlbumArtist,
+		Disc:        track.DiscNumber,
+		Index:       track.TrackNumber,
+		Available:   true,
+	}
+	if track.Artist != "" {
+		basic.Artists = []string{track.Artist}
+		basic.Name = fmt.Sprintf("%s - %s", track.Artist, track.Title)
+	}
+	if ms, err := strconv.ParseInt(track.DurationMillis, 10, 64); err == nil {
+		basic.Duration = time.Duration(ms) * time.Millisecond
+	}
+	return basic
+}
+
+func (g *Google) RemoveEntries(entryIds []string) error {
+	mutations := buildDeleteEntries(entryIds...)
+	content := &DataDeleteItem{mutations}
+
+	_, err := g.mutate(SJURL+"plentriesbatch?alt=json", content)
+	if isServiceError(err) {
+		return err
+	} else if err != nil {
 		return fmt.Errorf("Couldn't execute http query: %v", err)
 	}
 	return nil
 }
 
-func (g *Google) execute(method string, url string, content interface{}) ([]byte, error) {
-	var req *http.Request
-	var err error
+// Positions are large integers sent as strings
+type byAbsolutePosition []PlaylistEntry
 
+func (s byAbsolutePosition) Len() int      { return len(s) }
+func (s byAbsolutePosition) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byAbsolutePosition) Less(i, j int) bool {
+	a, b := s[i].AbsolutePosition, s[j].AbsolutePosition
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Sends a request that only reads, like a search or a feed, retrying it
+// while the service is throttling or failing. Closing cancel abandons the
+// request, returning errCancelled; a nil cancel never does.
+func (g *Google) execute(method string, url string, content interface{}, cancel <-chan struct{}) ([]byte, error) {
+	return g.send(method, url, content, cancel, false)
+}
+
+// Sends a mutation. Sending it again after the service may have applied it
+// would apply it twice, duplicating playlists or entries, so it is only
+// retried when it surely wasn't: when throttled or when no connection could
+// be made. Other failures are returned as they are, for a resume to pick up.
+func (g *Google) mutate(url string, content interface{}) ([]byte, error) {
+	return g.send("POST", url, content, nil, true)
+}
+
+func (g *Google) send(method string, url string, content interface{}, cancel <-chan struct{}, mutation bool) ([]byte, error) {
+	var jsonContent []byte
 	if method == "POST" {
-		bytes, err := json.Marshal(content)
+		var err error
+		jsonContent, err = json.Marshal(content)
 		if err != nil {
 			return nil, fmt.Errorf("Error marshalling track post data: %v", err)
 		}
-		jsonContent := string(bytes)
-		postContent := strings.NewReader(jsonContent)
 		// fmt.Printf("Executing %s request to %s with content:\n %s\n", method, url, jsonContent)
-		req, err = http.NewRequest(method, url, postContent)
+	}
+
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		header, err := g.auth.header()
+		if err != nil {
+			return nil, err
+		}
+		body, retryAfter, err := g.executeOnce(method, url, header, jsonContent, cancel)
+		if err == nil {
+			return body, nil
+		}
+		if _, ok := err.(*AuthError); ok && !refreshed && g.auth.refreshRejected(header) {
+			// The token was rejected before it was due to expire
+			refreshed = true
+			continue
+		}
+		if retryAfter < 0 || attempt >= maxRetries || (mutation && !notSent(err)) {
+			return nil, err
+		}
+		if retryAfter == 0 {
+			retryAfter = backoff(attempt)
+		}
+		if debug {
+			fmt.Printf("Retrying %s %s in %s: %v\n", method, url, retryAfter, err)
+		}
+		select {
+		case <-time.After(retryAfter):
+		case <-cancel:
+			return nil, errCancelled
+		}
+	}
+}
+
+// Sends a single request. When it fails, also returns how long to wait
+// before retrying: 0 to back off as usual, negative if it shouldn't be
+// retried at all.
+func (g *Google) executeOnce(method string, url string, authorization string, jsonContent []byte, cancel <-chan struct{}) ([]byte, time.Duration, error) {
+	var req *http.Request
+	var err error
+
+	if method == "POST" {
+		req, err = http.NewRequest(method, url, bytes.NewReader(jsonContent))
 	} else {
 		req, err = http.NewRequest(method, url, nil)
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("Error creating track post request: %v", err)
+		return nil, -1, fmt.Errorf("Error creating track post request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("GoogleLogin auth=%s", g.auth))
+	req.Header.Set("Authorization", authorization)
+	if !g.limiter.Wait(cancel) {
+		return nil, -1, errCancelled
+	}
+
+	if cancel != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-cancel:
+				g.transport.CancelRequest(req)
+			case <-done:
+			}
+		}()
+	}
+
 	resp, err := g.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("Error posting batch: %v", err)
+		if isClosed(cancel) {
+			return nil, -1, errCancelled
+		}
+		// Most likely a network blip, worth another try
+		return nil, 0, &NetworkError{Service: "Google", Err: err, Connect: connectFailed(err)}
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Returned status code %s", resp.StatusCode)
+	switch {
+	case resp.StatusCode == 200:
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return nil, -1, &AuthError{Service: "Google", StatusCode: resp.StatusCode}
+	case resp.StatusCode == 404:
+		return nil, -1, &NotFoundError{Service: "Google", URL: url}
+	case resp.StatusCode == 429:
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, retryAfter, &RateLimitError{Service: "Google", RetryAfter: retryAfter}
+	case resp.StatusCode >= 500:
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), &ServerError{Service: "Google", StatusCode: resp.StatusCode}
+	default:
+		return nil, -1, fmt.Errorf("Returned status code %d", resp.StatusCode)
 	}
 
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading login body: %s", err)
+		if isClosed(cancel) {
+			return nil, -1, errCancelled
+		}
+		return nil, -1, &NetworkError{Service: "Google", Err: err}
 	}
 
-	return body, nil
+	return body, 0, nil
+}
+
+// Whether a failed request surely never reached the service, so even a
+// mutation can be sent again
+func notSent(err error) bool {
+	switch e := err.(type) {
+	case *RateLimitError:
+		return true
+	case *NetworkError:
+		return e.Connect
+	}
+	return false
+}
+
+// Whether a request failed while connecting, before anything was sent
+func connectFailed(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// Exponential backoff with jitter: a random duration between half and all
+// of the base delay doubled for every attempt, capped at maxBackoff
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << uint(attempt)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Parses a Retry-After header given either in seconds or as an HTTP date.
+// Returns 0 when there is no usable value. Longer waits are capped at
+// maxBackoff, so a bad header can't stall a worker for hours.
+func parseRetryAfter(header string) time.Duration {
+	var d time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds > int(maxBackoff/time.Second) {
+			return maxBackoff
+		}
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		d = date.Sub(time.Now())
+	}
+	if d <= 0 {
+		return 0
+	}
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
 }
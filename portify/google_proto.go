@@ -2,7 +2,9 @@ package main
 
 import (
 	"github.com/rckclmbr/goportify/Godeps/_workspace/src/code.google.com/p/go-uuid/uuid"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type DataPlaylistItem struct {
@@ -13,6 +15,39 @@ type DataTrackItem struct {
 	Mutations []MutationTrackItem `json:"mutations"`
 }
 
+type DataDeleteItem struct {
+	Mutations []MutationDeleteItem `json:"mutations"`
+}
+
+type DataTrackMetadataItem struct {
+	Mutations []MutationTrackMetadataItem `json:"mutations"`
+}
+
+// Adds a track to the library with create, or changes one with update
+type MutationTrackMetadataItem struct {
+	Create *TrackMetadataItem `json:"create,omitempty"`
+	Update *TrackMetadataItem `json:"update,omitempty"`
+}
+
+type TrackMetadataItem struct {
+	Id                        string `json:"id,omitempty"`
+	Nid                       string `json:"nid"`
+	StoreId                   string `json:"storeId"`
+	Title                     string `json:"title,omitempty"`
+	Artist                    string `json:"artist,omitempty"`
+	Album                     string `json:"album,omitempty"`
+	TrackType                 int    `json:"trackType,omitempty"`
+	Rating                    string `json:"rating"`
+	LastRatingChangeTimestamp string `json:"lastRatingChangeTimestamp"`
+	CreationTimestamp         string `json:"creationTimestamp,omitempty"`
+	LastModifiedTimestamp     string `json:"lastModifiedTimestamp,omitempty"`
+	Deleted                   bool   `json:"deleted"`
+}
+
+type MutationDeleteItem struct {
+	Delete string `json:"delete"`
+}
+
 type MutationTrackItem struct {
 	Create CreateTrackItem `json:"create"`
 }
@@ -42,6 +77,72 @@ type CreatePlaylistItem struct {
 	AccessControlled      bool   `json:"accessControlled"`
 }
 
+type FeedRequest struct {
+	MaxResults string `json:"max-results"`
+	StartToken string `json:"start-token,omitempty"`
+}
+
+type PlaylistEntry struct {
+	Id               string `json:"id"`
+	ClientId         string `json:"clientId"`
+	PlaylistId       string `json:"playlistId"`
+	TrackId          string `json:"trackId"`
+	AbsolutePosition string `json:"absolutePosition"`
+	Source           string `json:"source"`
+	Deleted          bool   `json:"deleted"`
+	// Only sent for catalog tracks, library tracks are in the track feed
+	Track *LibraryTrack `json:"track,omitempty"`
+	// The catalog id of the track, filled in by PlaylistEntries. Empty for
+	// tracks that are only in the library, like uploads.
+	StoreId string `json:"-"`
+}
+
+type PlaylistEntryFeed struct {
+	Kind          string `json:"kind"`
+	NextPageToken string `json:"nextPageToken"`
+	Data          struct {
+		Items []PlaylistEntry `json:"items"`
+	} `json:"data"`
+}
+
+type GooglePlaylist struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Deleted     bool   `json:"deleted"`
+}
+
+type PlaylistFeed struct {
+	Kind          string `json:"kind"`
+	NextPageToken string `json:"nextPageToken"`
+	Data          struct {
+		Items []GooglePlaylist `json:"items"`
+	} `json:"data"`
+}
+
+type LibraryTrack struct {
+	Id             string `json:"id"`
+	Nid            string `json:"nid"`
+	StoreId        string `json:"storeId"`
+	Title          string `json:"title"`
+	Artist         string `json:"artist"`
+	Album          string `json:"album"`
+	AlbumArtist    string `json:"albumArtist"`
+	DurationMillis string `json:"durationMillis"`
+	DiscNumber     int    `json:"discNumber"`
+	TrackNumber    int    `json:"trackNumber"`
+	Deleted        bool   `json:"deleted"`
+}
+
+type TrackFeed struct {
+	Kind          string `json:"kind"`
+	NextPageToken string `json:"nextPageToken"`
+	Data          struct {
+		Items []LibraryTrack `json:"items"`
+	} `json:"data"`
+}
+
 type SearchResult struct {
 	Entries []struct {
 		Album struct {
@@ -105,6 +206,7 @@ type SearchResult struct {
 			DiscNumber                int      `json:"discNumber"`
 			DurationMillis            string   `json:"durationMillis"`
 			EstimatedSize             string   `json:"estimatedSize"`
+			ExplicitType              string   `json:"explicitType"`
 			Genre                     string   `json:"genre"`
 			Kind                      string   `json:"kind"`
 			Nid                       string   `json:"nid"`
@@ -178,6 +280,43 @@ func buildAddTracks(playlistId string, songIds ...string) []MutationTrackItem {
 	return mutations
 }
 
+// Rates catalog tracks, adding them to the library first if asked to
+func buildRateTracks(tracks []RelevantTrack, rating string, addToLibrary bool) []MutationTrackMetadataItem {
+	// Timestamps are in microseconds
+	now := strconv.FormatInt(time.Now().UnixNano()/1000, 10)
+	mutations := make([]MutationTrackMetadataItem, len(tracks))
+	for i, track := range tracks {
+		details := &TrackMetadataItem{
+			Id:                        track.Nid,
+			Nid:                       track.Nid,
+			StoreId:                   track.Nid,
+			Title:                     track.Title,
+			Artist:                    track.Artist,
+			Album:                     track.Album,
+			Rating:                    rating,
+			LastRatingChangeTimestamp: now,
+		}
+		if addToLibrary {
+			details.Id = ""
+			details.TrackType = 8 // AA track added to the library
+			details.CreationTimestamp = "-1"
+			details.LastModifiedTimestamp = "0"
+			mutations[i] = MutationTrackMetadataItem{Create: details}
+		} else {
+			mutations[i] = MutationTrackMetadataItem{Update: details}
+		}
+	}
+	return mutations
+}
+
+func buildDeleteEntries(entryIds ...string) []MutationDeleteItem {
+	mutations := make([]MutationDeleteItem, len(entryIds))
+	for i, entryId := range entryIds {
+		mutations[i] = MutationDeleteItem{Delete: entryId}
+	}
+	return mutations
+}
+
 func buildCreatePlaylist(name string, public bool) []MutationPlaylistItem {
 	mutations := make([]MutationPlaylistItem, 1)
 	mutations[0] = MutationPlaylistItem{
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Answers requests to Google with a handler instead of the network. A
+// handler returning an error fails the request with it instead.
+type stubTransport func(w http.ResponseWriter, r *http.Request) error
+
+func (s stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	if err := s(rec, r); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: rec.Code,
+		Header:     rec.HeaderMap,
+		Body:       ioutil.NopCloser(rec.Body),
+		Request:    r,
+	}, nil
+}
+
+// A Google logged in with a token that never expires, sending its requests
+// to handler
+func newStubGoogle(handler stubTransport) *Google {
+	client := &http.Client{Transport: handler}
+	auth := newGoogleAuth(AuthEndpoints{}, client)
+	auth.token = &Token{Type: tokenOAuth, AccessToken: "access"}
+	return &Google{
+		client:    client,
+		transport: &http.Transport{},
+		auth:      auth,
+		limiter:   newRateLimiter(1000, 1000),
+	}
+}
+
+// Answers with each of responses in turn, the last one over and over,
+// counting the requests
+type stubResponses struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter) error
+	requests  int
+}
+
+func (s *stubResponses) handle(w http.ResponseWriter, r *http.Request) error {
+	s.mu.Lock()
+	respond := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	s.requests++
+	s.mu.Unlock()
+	return respond(w)
+}
+
+func status(code int) func(w http.ResponseWriter) error {
+	return func(w http.ResponseWriter) error {
+		w.WriteHeader(code)
+		return nil
+	}
+}
+
+func body(text string) func(w http.ResponseWriter) error {
+	return func(w http.ResponseWriter) error {
+		io.WriteString(w, text)
+		return nil
+	}
+}
+
+func fail(err error) func(w http.ResponseWriter) error {
+	return func(w http.ResponseWriter) error {
+		return err
+	}
+}
+
+var connectError = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestMutationRetries(t *testing.T) {
+	created := `{"mutate_response": [{"id": "playlist", "response_code": "OK"}]}`
+	tests := []struct {
+		name      string
+		responses []func(w http.ResponseWriter) error
+		requests  int
+		ok        bool
+	}{
+		{"server error", []func(w http.ResponseWriter) error{status(500), body(created)}, 1, false},
+		{"lost response", []func(w http.ResponseWriter) error{fail(io.ErrUnexpectedEOF), body(created)}, 1, false},
+		{"throttled", []func(w http.ResponseWriter) error{status(429), body(created)}, 2, true},
+		{"connection refused", []func(w http.ResponseWriter) error{fail(connectError), body(created)}, 2, true},
+	}
+	for _, test := range tests {
+		stub := &stubResponses{responses: test.responses}
+		g := newStubGoogle(stub.handle)
+		id, err := g.CreatePlaylist("Playlist", false)
+		if test.ok && (err != nil || id != "playlist") {
+			t.Errorf("%s: CreatePlaylist = %q, %v, want it created", test.name, id, err)
+		}
+		if !test.ok && !isServiceError(err) {
+			t.Errorf("%s: CreatePlaylist returned %v, want a service error", test.name, err)
+		}
+		if stub.requests != test.requests {
+			t.Errorf("%s: sent %d requests, want %d", test.name, stub.requests, test.requests)
+		}
+	}
+}
+
+func TestReadRetries(t *testing.T) {
+	stub := &stubResponses{responses: []func(w http.ResponseWriter) error{
+		status(500),
+		fail(io.ErrUnexpectedEOF),
+		body(`{"entries": []}`),
+	}}
+	g := newStubGoogle(stub.handle)
+	if _, err := g.Search("query", 10, nil); err != nil {
+		t.Errorf("Search returned %v", err)
+	}
+	if stub.requests != 3 {
+		t.Errorf("sent %d requests, want 3", stub.requests)
+	}
+}
+
+// Creates the playlist entries it is sent, numbering them, except for the
+// tracks in rejected
+type entryStub struct {
+	rejected map[string]bool
+	batches  [][]CreateTrackItem
+	created  int
+}
+
+func (s *entryStub) handle(w http.ResponseWriter, r *http.Request) error {
+	var data DataTrackItem
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return err
+	}
+	batch := []CreateTrackItem{}
+	var response MutateResponseContainer
+	response.MutateResponse = make([]struct {
+		ClientID     string `json:"client_id"`
+		ID           string `json:"id"`
+		ResponseCode string `json:"response_code"`
+	}, len(data.Mutations))
+	for i, mutation := range data.Mutations {
+		batch = append(batch, mutation.Create)
+		if s.rejected[mutation.Create.TrackId] {
+			response.MutateResponse[i].ResponseCode = "INVALID_REQUEST"
+			continue
+		}
+		s.created++
+		response.MutateResponse[i].ID = fmt.Sprintf("entry%d", s.created)
+		response.MutateResponse[i].ResponseCode = "OK"
+	}
+	s.batches = append(s.batches, batch)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func songIds(n int) []string {
+	ids := []string{}
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("T%d", i))
+	}
+	return ids
+}
+
+func TestAddTracksBatches(t *testing.T) {
+	// The last track of the first batch is rejected, so the second batch
+	// follows the one before it
+	stub := &entryStub{rejected: map[string]bool{"T99": true}}
+	g := newStubGoogle(stub.handle)
+
+	sent := []int{}
+	err := g.AddTracks("playlist", songIds(2*mutationBatchSize+50), func(n int, rejected []MutationFailure) error {
+		sent = append(sent, n)
+		if n == mutationBatchSize && (len(rejected) != 1 || rejected[0].TrackId != "T99") {
+			t.Errorf("first batch rejected %v, want T99", rejected)
+		}
+		return nil
+	})
+	if mutationErr, ok := err.(*MutationError); !ok || len(mutationErr.Failures) != 1 {
+		t.Errorf("AddTracks returned %v, want T99 rejected", err)
+	}
+	if want := []int{100, 200, 250}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("batches ended after %v tracks, want %v", sent, want)
+	}
+	if len(stub.batches) != 3 {
+		t.Fatalf("sent %d batches, want 3", len(stub.batches))
+	}
+
+	first, second, third := stub.batches[0], stub.batches[1], stub.batches[2]
+	if first[0].PrecedingEntryId != "" {
+		t.Errorf("first entry follows %q, want it appended", first[0].PrecedingEntryId)
+	}
+	if first[1].PrecedingEntryId != first[0].ClientId || first[0].FollowingEntryId != first[1].ClientId {
+		t.Errorf("entries of a batch aren't linked to each other")
+	}
+	if last := first[len(first)-1]; last.FollowingEntryId != "" {
+		t.Errorf("last entry of a batch is followed by %q, which doesn't exist yet", last.FollowingEntryId)
+	}
+	if second[0].PrecedingEntryId != "entry99" {
+		t.Errorf("second batch follows %q, want the last entry created, entry99", second[0].PrecedingEntryId)
+	}
+	if third[0].PrecedingEntryId != "entry199" {
+		t.Errorf("third batch follows %q, want entry199", third[0].PrecedingEntryId)
+	}
+	if last := third[len(third)-1]; last.FollowingEntryId != "" {
+		t.Errorf("last entry is followed by %q, want it appended", last.FollowingEntryId)
+	}
+}
+
+func TestInsertTracksBatches(t *testing.T) {
+	stub := &entryStub{}
+	g := newStubGoogle(stub.handle)
+
+	if err := g.InsertTracks("playlist", songIds(mutationBatchSize+1), "before", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.batches) != 2 {
+		t.Fatalf("sent %d batches, want 2", len(stub.batches))
+	}
+	first, second := stub.batches[0], stub.batches[1]
+	if first[0].PrecedingEntryId != "before" {
+		t.Errorf("first entry follows %q, want %q", first[0].PrecedingEntryId, "before")
+	}
+	if last := first[len(first)-1]; last.FollowingEntryId != "" {
+		t.Errorf("last entry of the first batch is followed by %q", last.FollowingEntryId)
+	}
+	if second[0].PrecedingEntryId != "entry100" || second[0].FollowingEntryId != "after" {
+		t.Errorf("second batch goes between %q and %q, want entry100 and after", second[0].PrecedingEntryId, second[0].FollowingEntryId)
+	}
+}
+
+func TestAddTracksStops(t *testing.T) {
+	stub := &entryStub{}
+	g := newStubGoogle(stub.handle)
+
+	err := g.AddTracks("playlist", songIds(2*mutationBatchSize), func(n int, rejected []MutationFailure) error {
+		return errCancelled
+	})
+	if err != errCancelled || len(stub.batches) != 1 {
+		t.Errorf("AddTracks returned %v after %d batches, want it cancelled after 1", err, len(stub.batches))
+	}
+}
+
+func TestPlaylistEntriesStoreIds(t *testing.T) {
+	g := newStubGoogle(func(w http.ResponseWriter, r *http.Request) error {
+		switch {
+		case strings.Contains(r.URL.Path, "plentryfeed"):
+			io.WriteString(w, `{"data": {"items": [
+				{"id": "catalog", "playlistId": "playlist", "trackId": "Tcatalog", "absolutePosition": "1"},
+				{"id": "library", "playlistId": "playlist", "trackId": "library-1", "absolutePosition": "2"},
+				{"id": "upload", "playlistId": "playlist", "trackId": "library-2", "absolutePosition": "3"},
+				{"id": "other", "playlistId": "other", "trackId": "Tother", "absolutePosition": "1"}
+			]}}`)
+		case strings.Contains(r.URL.Path, "trackfeed"):
+			io.WriteString(w, `{"data": {"items": [
+				{"id": "library-1", "storeId": "Tlibrary"},
+				{"id": "library-2", "title": "Upload"}
+			]}}`)
+		default:
+			w.WriteHeader(404)
+		}
+		return nil
+	})
+
+	entries, err := g.PlaylistEntries("playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeIds := []string{}
+	for _, entry := range entries {
+		storeIds = append(storeIds, entry.Id+":"+entry.StoreId)
+	}
+	if want := []string{"catalog:Tcatalog", "library:Tlibrary", "upload:"}; !reflect.DeepEqual(storeIds, want) {
+		t.Errorf("entries %v, want %v", storeIds, want)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a transfer job
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobPaused    = "paused"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// What the status endpoints report about a transfer job
+type JobStatus struct {
+	ID            string           `json:"id"`
+	State         string           `json:"state"`
+	Source        string           `json:"source"`
+	Destination   string           `json:"destination"`
+	Created       time.Time        `json:"created"`
+	Started       time.Time        `json:"started"`
+	Finished      time.Time        `json:"finished"`
+	Error         string           `json:"error,omitempty"`
+	Playlists     []PlaylistStatus `json:"playlists"`
+	Progress      ProgressType     `json:"progress"`
+	Found         int              `json:"found"`
+	LowConfidence int              `json:"low_confidence"`
+	NotFound      int              `json:"not_found"`
+	AddFailed     int              `json:"add_failed"`
+}
+
+// A transfer started from the web interface, running in the background
+type job struct {
+	t         *transfer
+	req       *TransferRequest
+	playlists []Playlist
+	created   time.Time
+
+	mu       sync.Mutex
+	state    string
+	started  time.Time
+	finished time.Time
+}
+
+// Keeps track of the transfer jobs started since the server started
+type jobManager struct {
+	mu   sync.Mutex
+	jobs []*job
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{}
+}
+
+// Runs a transfer in the background. A job with the same ID that has
+// finished, such as the run a resume picks up from, is replaced.
+func (m *jobManager) start(t *transfer, req *TransferRequest, playlists []Playlist) (*job, error) {
+	j := &job{t: t, req: req, playlists: playlists, created: time.Now(), state: jobQueued}
+
+	m.mu.Lock()
+	for i, other := range m.jobs {
+		if other.t.id != t.id {
+			continue
+		}
+		if !other.isFinished() {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("Transfer %s is still running", t.id)
+		}
+		m.jobs = append(m.jobs[:i], m.jobs[i+1:]...)
+		break
+	}
+	m.jobs = append(m.jobs, j)
+	m.mu.Unlock()
+
+	go j.run()
+	return j, nil
+}
+
+// Looks up a job by its ID
+func (m *jobManager) get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.t.id == id {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the status of every job, oldest first
+func (m *jobManager) list() []JobStatus {
+	m.mu.Lock()
+	jobs := append([]*job(nil), m.jobs...)
+	m.mu.Unlock()
+
+	statuses := make([]JobStatus, len(jobs))
+	for i, j := range jobs {
+		statuses[i] = j.status()
+	}
+	return statuses
+}
+
+func (j *job) run() {
+	j.mu.Lock()
+	j.state = jobRunning
+	j.started = time.Now()
+	j.mu.Unlock()
+
+	j.t.run(j.playlists)
+	if e, ok := j.t.out.(*jobEmitter); ok {
+		e.release(eventLogGrace)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch err := j.t.aborted(); {
+	case err == errCancelled:
+		j.state = jobCancelled
+	case err != nil:
+		j.state = jobFailed
+	default:
+		j.state = jobDone
+	}
+	j.finished = time.Now()
+}
+
+func (j *job) isFinished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == jobDone || j.state == jobFailed || j.state == jobCancelled
+}
+
+// Cancels the job, returning false if it had already finished
+func (j *job) cancel() bool {
+	if j.isFinished() {
+		return false
+	}
+	j.t.cancel()
+	return true
+}
+
+// Pauses the job before its next track
+func (j *job) pause() error {
+	if j.isFinished() {
+		return fmt.Errorf("Transfer already finished.")
+	}
+	if !j.t.pause() {
+		return fmt.Errorf("Transfer already paused.")
+	}
+	return nil
+}
+
+// Carries on with a paused job
+func (j *job) unpause() error {
+	if j.isFinished() {
+		return fmt.Errorf("Transfer already finished.")
+	}
+	if !j.t.unpause() {
+		return fmt.Errorf("Transfer isn't paused.")
+	}
+	return nil
+}
+
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	status := JobStatus{
+		ID:          j.t.id,
+		State:       j.state,
+		Source:      j.req.Source,
+		Destination: j.req.Destination,
+		Created:     j.created,
+		Started:     j.started,
+		Finished:    j.finished,
+	}
+	j.mu.Unlock()
+
+	if status.State == jobRunning && j.t.isPaused() {
+		status.State = jobPaused
+	}
+	if err := j.t.aborted(); err != nil {
+		status.Error = err.Error()
+	}
+	status.Playlists, status.Progress = j.t.status()
+	status.Found, status.LowConfidence, status.NotFound = j.t.counts()
+	status.AddFailed = j.t.addFailures()
+	return status
+}
+
+// Sends the unmatched tracks report of a job as a download, in the format
+// given by the format parameter (csv or json, the default)
+func (s *Server) transferReport(w http.ResponseWriter, r *http.Request, j *job) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = reportJSON
+	}
+	if format != reportCSV && format != reportJSON {
+		http.Error(w, fmt.Sprintf("Unknown report format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	contentType := "application/json"
+	if format == reportCSV {
+		contentType = "text/csv"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"portify-%s-unmatched.%s\"", j.t.id, format))
+	if err := writeReport(w, unmatchedTracks(j.t.matchReport()), format); err != nil {
+		fmt.Printf("Error sending report: %v\n", err)
+	}
+}
+
+// Returns whether a cancel channel has been closed. A nil channel never is.
+func isClosed(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Lists every transfer job
+func (s *Server) transferList(w http.ResponseWriter, r *http.Request) {
+	response := &Response{Status: 200, Message: "ok", Data: s.jobs.list()}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Serves GET /portify/transfer/{id} and /report, and POST
+// /portify/transfer/{id}/cancel, /pause and /resume
+func (s *Server) transferJob(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/portify/transfer/"), "/")
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if len(parts) > 2 || (len(parts) == 2 && action != "report" && action != "cancel" && action != "pause" && action != "resume") {
+		http.NotFound(w, r)
+		return
+	}
+	if action != "" && action != "report" && r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Use a POST to %s a transfer", action), http.StatusMethodNotAllowed)
+		return
+	}
+
+	j, ok := s.jobs.get(parts[0])
+	if ok && action == "report" {
+		s.transferReport(w, r, j)
+		return
+	}
+	if !ok {
+		response = &Response{Status: 404, Message: fmt.Sprintf("No transfer %s", parts[0])}
+	} else {
+		var err error
+		message := "ok"
+		switch action {
+		case "cancel":
+			if !j.cancel() {
+				err = fmt.Errorf("Transfer already finished.")
+			}
+			message = "transfer will stop."
+		case "pause":
+			err = j.pause()
+			message = "transfer will pause."
+		case "resume":
+			err = j.unpause()
+			message = "transfer resumed."
+		}
+		if err != nil {
+			response = &Response{Status: 400, Message: err.Error()}
+		} else {
+			response = &Response{Status: 200, Message: message, Data: j.status()}
+		}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoints of a transfer, written as it progresses so a transfer that was
+// interrupted can be resumed without creating or adding anything twice
+type Journal struct {
+	ID             string                      `json:"id"`
+	Source         string                      `json:"source"`
+	Destination    string                      `json:"destination"`
+	Playlists      []Playlist                  `json:"playlists"`
+	Sync           bool                        `json:"sync"`
+	SyncRemove     bool                        `json:"sync_remove"`
+	StarredRatings bool                        `json:"starred_ratings"`
+	StarredLibrary bool                        `json:"starred_library"`
+	Started        time.Time                   `json:"started"`
+	Finished       bool                        `json:"finished"`
+	Entries        map[string]*JournalPlaylist `json:"entries"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// The progress of a single playlist, keyed in the journal by source URI
+type JournalPlaylist struct {
+	Name          string       `json:"name"`
+	Matched       bool         `json:"matched"`
+	Matches       []TrackMatch `json:"matches,omitempty"`
+	DestinationId string       `json:"destination_id,omitempty"`
+	// How many of the found tracks were added so far, a batch at a time
+	SongsAdded  int  `json:"songs_added,omitempty"`
+	TracksAdded bool `json:"tracks_added"`
+	Done        bool `json:"done"`
+}
+
+// Starts the journal of the new transfer with the given ID in dir
+func newJournal(dir string, id string, transferReq *TransferRequest) (*Journal, error) {
+	j := &Journal{
+		ID:             id,
+		Source:         transferReq.Source,
+		Destination:    transferReq.Destination,
+		Playlists:      transferReq.Playlists,
+		Sync:           transferReq.Sync,
+		SyncRemove:     transferReq.SyncRemove,
+		StarredRatings: transferReq.StarredRatings,
+		StarredLibrary: transferReq.StarredLibrary,
+		Started:        time.Now(),
+		Entries:        make(map[string]*JournalPlaylist),
+		path:           filepath.Join(dir, id+".json"),
+	}
+	return j, j.save()
+}
+
+// Loads the journal of the transfer with the given ID from dir
+func loadJournal(dir string, id string) (*Journal, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("Invalid transfer id %q", id)
+	}
+	path := filepath.Join(dir, id+".json")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No journal for transfer %s", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading journal: %v", err)
+	}
+
+	j := &Journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("Error parsing journal %s: %v", path, err)
+	}
+	if j.Entries == nil {
+		j.Entries = make(map[string]*JournalPlaylist)
+	}
+	return j, nil
+}
+
+// The request that started the transfer, to run it again
+func (j *Journal) request() *TransferRequest {
+	return &TransferRequest{
+		Source:         j.Source,
+		Destination:    j.Destination,
+		Playlists:      j.Playlists,
+		Sync:           j.Sync,
+		SyncRemove:     j.SyncRemove,
+		StarredRatings: j.StarredRatings,
+		StarredLibrary: j.StarredLibrary,
+	}
+}
+
+// Loads every journal in dir, skipping files that can't be parsed
+func listJournals(dir string) ([]*Journal, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	journals := []*Journal{}
+	for _, path := range paths {
+		j, err := loadJournal(dir, strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			fmt.Printf("Skipping journal: %v\n", err)
+			continue
+		}
+		journals = append(journals, j)
+	}
+	return journals, nil
+}
+
+// Returns the entry of a playlist, creating it if needed
+func (j *Journal) playlist(p Playlist) *JournalPlaylist {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok := j.Entries[p.Uri]
+	if !ok {
+		entry = &JournalPlaylist{Name: p.Name}
+		j.Entries[p.Uri] = entry
+	}
+	return entry
+}
+
+// Applies a change to a playlist entry and checkpoints the journal
+func (j *Journal) update(entry *JournalPlaylist, change func(entry *JournalPlaylist)) error {
+	j.mu.Lock()
+	change(entry)
+	j.mu.Unlock()
+	return j.save()
+}
+
+func (j *Journal) finish() error {
+	j.mu.Lock()
+	j.Finished = true
+	j.mu.Unlock()
+	return j.save()
+}
+
+// Deletes the journal of a transfer that never ran, so it isn't offered for
+// resuming
+func (j *Journal) remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing journal: %v", err)
+	}
+	return nil
+}
+
+func (j *Journal) save() error {
+	j.mu.Lock()
+	data, err := json.MarshalIndent(j, "", "  ")
+	j.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Error marshalling journal: %v", err)
+	}
+	if err := writeFileAtomic(j.path, data); err != nil {
+		return fmt.Errorf("Error writing journal: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestJournalRemove(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := newJournal(dir, "transfer", &TransferRequest{Playlists: []Playlist{{Uri: "playlist"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journals, err := listJournals(dir); err != nil || len(journals) != 1 {
+		t.Fatalf("listed %d journals, %v, want the new one", len(journals), err)
+	}
+	if err := j.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if journals, err := listJournals(dir); err != nil || len(journals) != 0 {
+		t.Errorf("listed %d journals, %v, after removing the only one", len(journals), err)
+	}
+	if err := j.remove(); err != nil {
+		t.Errorf("removing again returned %v", err)
+	}
+}
@@ -2,19 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/rckclmbr/goportify/Godeps/_workspace/src/code.google.com/p/go-uuid/uuid"
 	"github.com/rckclmbr/goportify/Godeps/_workspace/src/github.com/elazarl/go-bindata-assetfs"
 	"github.com/rckclmbr/goportify/Godeps/_workspace/src/github.com/googollee/go-socket.io"
 	"github.com/rckclmbr/goportify/Godeps/_workspace/src/github.com/skratchdot/open-golang/open"
 	"log"
 	"net/http"
+	"os"
+	"sync"
 )
 
 var (
 	debug = false
 )
 
-//{"status": 200, "message": "ok", "data":
+// {"status": 200, "message": "ok", "data":
 type Response struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message"`
@@ -29,6 +33,7 @@ type SocketIOResponse struct {
 type PlaylistType struct {
 	Playlist Playlist `json:"playlist"`
 	Name     string   `json:"name"`
+	Index    int      `json:"index"`
 }
 
 type PlaylistLengthType struct {
@@ -42,10 +47,41 @@ type TrackType struct {
 }
 
 type AddedType struct {
-	SpotifyTrackUri  string `json:"spotify_track_uri"`
-	SpotifyTrackName string `json:"spotify_track_name"`
-	Found            bool   `json:"found"`
-	Karaoke          bool   `json:"karaoke"`
+	Index            int     `json:"index"`
+	SpotifyTrackUri  string  `json:"spotify_track_uri"`
+	SpotifyTrackName string  `json:"spotify_track_name"`
+	Found            bool    `json:"found"`
+	LowConfidence    bool    `json:"low_confidence"`
+	Confidence       float64 `json:"confidence"`
+	Karaoke          bool    `json:"karaoke"`
+}
+
+type TransferRequest struct {
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Playlists   []Playlist `json:"playlists"`
+	Sync        bool       `json:"sync"`
+	SyncRemove  bool       `json:"sync_remove"`
+	// Give the starred tracks a thumbs up instead of copying them to a
+	// playlist, optionally adding them to the library too
+	StarredRatings bool `json:"starred_ratings"`
+	StarredLibrary bool `json:"starred_library"`
+}
+
+type TransferStartedType struct {
+	ID string `json:"id"`
+}
+
+type AuthRequiredType struct {
+	Service string `json:"service"`
+}
+
+type ProgressType struct {
+	Total           int     `json:"total"`
+	Done            int     `json:"done"`
+	InFlight        int     `json:"in_flight"`
+	Queued          int     `json:"queued"`
+	TracksPerSecond float64 `json:"tracks_per_second"`
 }
 
 type LoginRequest struct {
@@ -55,30 +91,87 @@ type LoginRequest struct {
 }
 
 type Server struct {
-	goog *Google
-	sp   *Spotify
-	sios *socketio.Server
-	sio  socketio.Socket
+	goog         *Google
+	sp           *Spotify
+	files        *FileSource
+	sources      map[string]Source
+	destinations map[string]Destination
+	sios         *socketio.Server
+
+	cache    *matchCache
+	mappings *playlistMappings
+	paths    Paths
+	jobs     *jobManager
+
+	mu        sync.Mutex
+	settings  Settings
+	eventLogs map[string]*eventLog
+	// The device login waiting for the user, if any
+	deviceLogin *deviceLogin
+	// Held while corrections from a review are made
+	reviewMu sync.Mutex
 }
 
-func newServer() (*Server, error) {
-	goog := NewGoogle()
+func newServer(paths Paths, endpoints AuthEndpoints) (*Server, error) {
+	goog := NewGoogle(endpoints)
+	if err := goog.PersistLogin(newTokenStore(paths.GoogleToken)); err != nil {
+		// Not fatal, the user can log in again
+		fmt.Println(err)
+	}
 	sp, err := NewSpotify()
 	if err != nil {
 		return nil, fmt.Errorf("Error initializting spotify: %s", err)
 	}
 
+	cache, err := loadMatchCache(paths.MatchCache)
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := loadPlaylistMappings(paths.PlaylistMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	files := newFileSource(paths.Uploads)
+
 	ioServer, err := socketio.NewServer(nil)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating socketio server: %s", err)
 	}
-	server := &Server{goog: goog, sp: sp, sios: ioServer}
+	ioServer.SetAdaptor(newLockedBroadcast())
+	server := &Server{
+		goog:         goog,
+		sp:           sp,
+		files:        files,
+		sources:      map[string]Source{"spotify": sp, "google": goog, fileSourceName: files},
+		destinations: map[string]Destination{"google": goog},
+		sios:         ioServer,
+		cache:        cache,
+		mappings:     mappings,
+		paths:        paths,
+		jobs:         newJobManager(),
+		settings:     defaultSettings,
+		eventLogs:    make(map[string]*eventLog),
+	}
 
 	ioServer.On("connection", func(so socketio.Socket) {
 		so.On("test", func(msg string) {
 			fmt.Println(msg)
 		})
-		server.sio = so
+		so.On("subscribe", server.subscribe)
+		so.On("unsubscribe", func(so socketio.Socket, id string) {
+			so.Leave(jobRoom(id))
+		})
+		so.On("pause", func(id string) {
+			if j, ok := server.jobs.get(id); ok {
+				j.pause()
+			}
+		})
+		so.On("resume", func(id string) {
+			if j, ok := server.jobs.get(id); ok {
+				j.unpause()
+			}
+		})
 	})
 	ioServer.On("error", func(so socketio.Socket, err error) {
 		fmt.Printf("socketio error: %s", err)
@@ -88,17 +181,54 @@ func newServer() (*Server, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "transfer":
+			os.Exit(runTransferCommand(os.Args[2:]))
+		case "cache":
+			os.Exit(runCacheCommand(os.Args[2:]))
+		case "export":
+			os.Exit(runExportCommand(os.Args[2:]))
+		case "login":
+			os.Exit(runLoginCommand(os.Args[2:]))
+		}
+	}
 
-	server, err := newServer()
+	var paths Paths
+	paths.registerFlags(flag.CommandLine)
+	var endpoints AuthEndpoints
+	endpoints.registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	server, err := newServer(paths, endpoints)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	http.Handle("/socket.io/", server.sios)
 	http.HandleFunc("/google/login", server.googleLogin)
+	http.HandleFunc("/google/login/status", server.googleLoginStatus)
+	http.HandleFunc("/google/login/device", server.googleDeviceLogin)
+	http.HandleFunc("/google/login/authorize", server.googleAuthorize)
+	http.HandleFunc("/google/login/callback", server.googleCallback)
+	http.HandleFunc("/google/logout", server.googleLogout)
+	http.HandleFunc("/google/playlists", server.googlePlaylists)
+	http.HandleFunc("/google/export", server.googleExport)
 	http.HandleFunc("/spotify/login", server.spotifyLogin)
 	http.HandleFunc("/spotify/playlists", server.spotifyPlaylists)
+	http.HandleFunc("/spotify/export", server.spotifyExport)
+	http.HandleFunc("/portify/files", server.playlistFiles)
 	http.HandleFunc("/portify/transfer/start", server.transferStart)
+	http.HandleFunc("/portify/transfer/dryrun", server.transferDryRun)
+	http.HandleFunc("/portify/transfer/resume", server.transferResume)
+	http.HandleFunc("/portify/transfer/journals", server.transferJournals)
+	http.HandleFunc("/portify/transfer/", server.transferJob)
+	http.HandleFunc("/portify/transfers", server.transferList)
+	http.HandleFunc("/portify/review/", server.reviewHandler)
+	http.HandleFunc("/portify/settings", server.settingsHandler)
+	http.HandleFunc("/portify/cache", server.cacheList)
+	http.HandleFunc("/portify/cache/invalidate", server.cacheInvalidate)
+	http.HandleFunc("/portify/cache/clear", server.cacheClear)
 
 	fs := http.FileServer(&assetfs.AssetFS{Asset: Asset, AssetDir: AssetDir, Prefix: "static"})
 	http.Handle("/", fs)
@@ -135,6 +265,137 @@ func (s *Server) googleLogin(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
+// Where browser logins come back to
+const googleCallbackPath = "/google/login/callback"
+
+type deviceLogin struct {
+	Code    *DeviceCode `json:"code"`
+	Pending bool        `json:"pending"`
+	Error   string      `json:"error,omitempty"`
+	// Closed to stop waiting when another device login replaces this one
+	cancel chan struct{}
+}
+
+type GoogleLoginStatusType struct {
+	LoggedIn bool         `json:"logged_in"`
+	Device   *deviceLogin `json:"device,omitempty"`
+}
+
+// Tells whether Google is logged in, for example from a login saved by an
+// earlier run, and how a device login is going
+func (s *Server) googleLoginStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := GoogleLoginStatusType{LoggedIn: s.goog.LoggedIn()}
+	if s.deviceLogin != nil {
+		device := *s.deviceLogin
+		status.Device = &device
+	}
+	s.mu.Unlock()
+	response := &Response{Status: 200, Message: "ok", Data: status}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Starts a device login, responding with the code the user has to enter.
+// GET /google/login/status tells when they did.
+func (s *Server) googleDeviceLogin(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+	if r.Method != "POST" {
+		http.Error(w, "Use a POST to start a device login", http.StatusMethodNotAllowed)
+		return
+	}
+
+	code, err := s.goog.RequestDeviceCode()
+	if err != nil {
+		response = &Response{Status: 400, Message: err.Error()}
+	} else {
+		login := &deviceLogin{Code: code, Pending: true, cancel: make(chan struct{})}
+		s.mu.Lock()
+		if s.deviceLogin != nil {
+			close(s.deviceLogin.cancel)
+		}
+		s.deviceLogin = login
+		s.mu.Unlock()
+		go func() {
+			err := s.goog.WaitForDeviceLogin(code, login.cancel)
+			s.mu.Lock()
+			login.Pending = false
+			if err != nil {
+				login.Error = err.Error()
+			}
+			s.mu.Unlock()
+		}()
+		response = &Response{Status: 200, Message: "ok", Data: code}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Sends the browser to log in with Google
+func (s *Server) googleAuthorize(w http.ResponseWriter, r *http.Request) {
+	authURL, err := s.goog.AuthCodeURL(callbackURL(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Finishes a browser login, then carries on to the Spotify login
+func (s *Server) googleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("Google login failed: %s", e), http.StatusBadRequest)
+		return
+	}
+	if err := s.goog.ExchangeCode(q.Get("code"), q.Get("state"), callbackURL(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/#/spotify/login", http.StatusFound)
+}
+
+// The URL browser logins come back to, on the host they were started from
+func callbackURL(r *http.Request) string {
+	return "http://" + r.Host + googleCallbackPath
+}
+
+func (s *Server) googleLogout(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+	if r.Method != "POST" {
+		http.Error(w, "Use a POST to log out", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.goog.Logout(); err != nil {
+		response = &Response{Status: 500, Message: err.Error()}
+	} else {
+		response = &Response{Status: 200, Message: "logged out."}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 func (s *Server) spotifyLogin(w http.ResponseWriter, r *http.Request) {
 	var response *Response
 	var login LoginRequest
@@ -168,7 +429,41 @@ func (s *Server) spotifyPlaylists(w http.ResponseWriter, r *http.Request) {
 		response = &Response{Status: 402, Message: "Spotify: not logged in"}
 	} else {
 		spPlaylists := s.sp.AllPlaylists()
-		response = &Response{Status: 200, Message: "ok", Data: spPlaylists}
+		if r.URL.Query().Get("tree") != "" {
+			response = &Response{Status: 200, Message: "ok", Data: playlistTree(spPlaylists)}
+		} else {
+			response = &Response{Status: 200, Message: "ok", Data: spPlaylists}
+		}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Lists the Google playlists of the user, to transfer or export them
+func (s *Server) googlePlaylists(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+	if !s.goog.LoggedIn() {
+		response = &Response{Status: 401, Message: "Google: not logged in."}
+	} else {
+		playlists, err := s.goog.Playlists()
+		if isAuthError(err) {
+			response = &Response{Status: 401, Message: err.Error()}
+		} else if err != nil {
+			response = &Response{Status: 500, Message: err.Error()}
+		} else {
+			data := []Playlist{}
+			for _, p := range playlists {
+				data = append(data, p.playlist())
+			}
+			response = &Response{Status: 200, Message: "ok", Data: data}
+		}
 	}
 
 	js, err := json.Marshal(response)
@@ -184,24 +479,31 @@ func (s *Server) spotifyPlaylists(w http.ResponseWriter, r *http.Request) {
 func (s *Server) transferStart(w http.ResponseWriter, r *http.Request) {
 	var response *Response
 
-	var playlists []Playlist
-	err := json.NewDecoder(r.Body).Decode(&playlists)
+	var transferReq TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&transferReq)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Invalid playlists specified: %s", err), http.StatusBadRequest)
 		return
 	}
 
-	if !s.goog.LoggedIn() {
-		response = &Response{Status: 401, Message: "Google: not logged in."}
-	} else if !s.sp.LoggedIn() {
-		response = &Response{Status: 402, Message: "Spotify: not logged in"}
-	} else if len(playlists) == 0 {
-		response = &Response{Status: 403, Message: "Please select at least one playlist."}
+	t, response := s.prepareTransfer(uuid.New(), &transferReq)
+	if response == nil {
+		t.journal, err = newJournal(s.paths.Journals, t.id, &transferReq)
+		if err != nil {
+			response = &Response{Status: 500, Message: err.Error()}
+			t.out.(*jobEmitter).release(0)
+		}
 	}
-
 	if response == nil {
-		go s.doTransferStart(playlists)
-		response = &Response{Status: 200, Message: "transfer will start."}
+		if _, err := s.jobs.start(t, &transferReq, transferReq.Playlists); err != nil {
+			response = &Response{Status: 409, Message: err.Error()}
+			t.out.(*jobEmitter).release(0)
+			if err := t.journal.remove(); err != nil {
+				fmt.Printf("%v\n", err)
+			}
+		} else {
+			response = &Response{Status: 200, Message: "transfer will start.", Data: TransferStartedType{t.id}}
+		}
 	}
 
 	js, err := json.Marshal(response)
@@ -214,85 +516,154 @@ func (s *Server) transferStart(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func (s *Server) doTransferStart(playlists []Playlist) {
-	// Convert to map to check for playlist
-	playlistMap := make(map[string]bool)
-	for _, playlist := range playlists {
-		playlistMap[playlist.Uri] = true
+type ResumeRequest struct {
+	ID string `json:"id"`
+}
+
+// Picks an interrupted transfer up from its journal
+func (s *Server) transferResume(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	var resumeReq ResumeRequest
+	err := json.NewDecoder(r.Body).Decode(&resumeReq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid transfer specified: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	journal, err := loadJournal(s.paths.Journals, resumeReq.ID)
+	if err != nil {
+		response = &Response{Status: 404, Message: err.Error()}
+	} else if journal.Finished {
+		response = &Response{Status: 400, Message: "Transfer already finished."}
 	}
 
-	// Iterate over all spotify playlists (should be cached anyway)
-	spPlaylists := s.sp.AllPlaylists()
-	for i, spPlaylist := range spPlaylists {
-		if _, ok := playlistMap[spPlaylist.Uri]; ok {
-			s.startPlaylist(i, spPlaylist)
+	if response == nil {
+		var t *transfer
+		transferReq := journal.request()
+		t, response = s.prepareTransfer(journal.ID, transferReq)
+		if response == nil {
+			t.journal = journal
+			if _, err := s.jobs.start(t, transferReq, journal.Playlists); err != nil {
+				response = &Response{Status: 409, Message: err.Error()}
+				t.out.(*jobEmitter).release(0)
+			} else {
+				response = &Response{Status: 200, Message: "transfer will resume.", Data: TransferStartedType{journal.ID}}
+			}
 		}
 	}
 
-	s.sio.Emit("portify", &SocketIOResponse{"all_done", nil})
-	fmt.Printf("Complete\n")
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
-func (s *Server) startPlaylist(i int, spPlaylist Playlist) {
-	trackChan, count := s.sp.PlaylistTracks(&spPlaylist)
-	s.sio.Emit("portify", &SocketIOResponse{"playlist_length", PlaylistLengthType{count}})
-	s.sio.Emit("portify", &SocketIOResponse{"playlist_started", PlaylistType{spPlaylist, spPlaylist.Name}})
-	err := s.createFullPlaylist(spPlaylist.Name, trackChan, count, i)
-	s.sio.Emit("portify", &SocketIOResponse{"playlist_done", PlaylistType{spPlaylist, spPlaylist.Name}})
+// Lists the journal of every transfer that was started
+func (s *Server) transferJournals(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	journals, err := listJournals(s.paths.Journals)
+	if err != nil {
+		response = &Response{Status: 500, Message: err.Error()}
+	} else {
+		response = &Response{Status: 200, Message: "ok", Data: journals}
+	}
+
+	js, err := json.Marshal(response)
 	if err != nil {
-		fmt.Printf("Error creating playlist %s: %v", spPlaylist.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
-func (s *Server) createFullPlaylist(playlistName string, trackChan chan BasicTrack, trackCount int, playlistNum int) error {
-	fmt.Printf("Processing playlist '%s'\n", playlistName)
-	googSongNids := []string{}
+// Matches every track of the requested playlists without creating anything
+// in the destination, and responds with the per-track report.
+func (s *Server) transferDryRun(w http.ResponseWriter, r *http.Request) {
+	var response *Response
 
-	done := make(chan int)
-	for i := 0; i < trackCount; i++ {
-		go func(i int) {
-			prefix := fmt.Sprintf("(%d:%d/%d)", playlistNum, i+1, trackCount)
+	var transferReq TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&transferReq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid playlists specified: %s", err), http.StatusBadRequest)
+		return
+	}
 
-			track := <-trackChan
-			bestTrack, err := s.goog.FindBestTrack(track.Name)
-			if err != nil {
-				fmt.Printf("%s: Couldn't find track: %s\n", prefix, err)
-				s.sio.Emit("gmusic", &SocketIOResponse{"not_added",
-					AddedType{
-						Found:            false,
-						SpotifyTrackUri:  track.Uri,
-						SpotifyTrackName: track.Name,
-					},
-				},
-				)
-			} else {
-				googSongNids = append(googSongNids, bestTrack.Nid)
-				fmt.Printf("%s: '%s' -> '%s - %s'\n", prefix, track.Name, bestTrack.Artist, bestTrack.Title)
-				s.sio.Emit("gmusic", &SocketIOResponse{"added",
-					AddedType{
-						Found:            true,
-						SpotifyTrackUri:  track.Uri,
-						SpotifyTrackName: track.Name,
-					},
-				},
-				)
-			}
-			done <- i
-		}(i)
+	t, response := s.prepareTransfer(uuid.New(), &transferReq)
+	if response == nil {
+		t.dryRun = true
+		t.run(transferReq.Playlists)
+		// Nobody was told the id, so nobody can catch up on the events
+		t.out.(*jobEmitter).release(0)
+		response = &Response{Status: 200, Message: "ok", Data: t.matchReport()}
 	}
 
-	for i := 0; i < trackCount; i++ {
-		<-done
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Resolves the source and destination of a transfer request, for the job
+// with the given ID. Returns the error response to send instead if the
+// transfer can't be started.
+func (s *Server) prepareTransfer(id string, transferReq *TransferRequest) (*transfer, *Response) {
+	if transferReq.Source == "" {
+		transferReq.Source = defaultSource
+	}
+	if transferReq.Destination == "" {
+		transferReq.Destination = defaultDestination
 	}
 
-	fmt.Printf("Creating '%s' in Google Music\n", playlistName)
-	playlistId, err := s.goog.CreatePlaylist(playlistName, false)
+	if err := checkTransferServices(transferReq.Source, transferReq.Destination); err != nil {
+		return nil, &Response{Status: 400, Message: err.Error()}
+	}
+	src, err := s.source(transferReq.Source)
 	if err != nil {
-		return fmt.Errorf("Error creating playlist: %v", err)
+		return nil, &Response{Status: 400, Message: err.Error()}
 	}
-	s.goog.AddTracks(playlistId, googSongNids)
+	dst, err := s.destination(transferReq.Destination)
 	if err != nil {
-		return fmt.Errorf("Error adding tracks to playlist: %v", err)
+		return nil, &Response{Status: 400, Message: err.Error()}
+	}
+	if err := checkStarredRatings(dst, transferReq.StarredRatings); err != nil {
+		return nil, &Response{Status: 400, Message: err.Error()}
 	}
-	return nil
+
+	if !dst.LoggedIn() {
+		return nil, notLoggedIn(401, transferReq.Destination)
+	} else if !src.LoggedIn() {
+		return nil, notLoggedIn(402, transferReq.Source)
+	} else if len(transferReq.Playlists) == 0 {
+		return nil, &Response{Status: 403, Message: "Please select at least one playlist."}
+	}
+
+	settings := s.currentSettings()
+	nameTemplate, err := parsePlaylistNameTemplate(settings.PlaylistNameTemplate)
+	if err != nil {
+		return nil, &Response{Status: 500, Message: err.Error()}
+	}
+
+	t := newTransfer(newJobEmitter(s, id), src, dst)
+	t.id = id
+	t.workers = settings.Workers
+	t.nameTemplate = nameTemplate
+	t.cache = s.cache
+	t.sync = transferReq.Sync
+	t.syncRemove = transferReq.SyncRemove
+	t.starredRatings = transferReq.StarredRatings
+	t.starredLibrary = transferReq.StarredLibrary
+	t.mappings = s.mappings
+	return t, nil
 }
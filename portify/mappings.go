@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Remembers which destination playlist each source playlist was copied to,
+// keyed by source playlist URI, so it can be synced later on
+type playlistMappings struct {
+	path string
+
+	mu       sync.Mutex
+	mappings map[string]string
+}
+
+// Loads the mappings stored at path, starting empty if there are none yet
+func loadPlaylistMappings(path string) (*playlistMappings, error) {
+	m := &playlistMappings{path: path, mappings: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading playlist mappings: %v", err)
+	}
+	if err := json.Unmarshal(data, &m.mappings); err != nil {
+		return nil, fmt.Errorf("Error parsing playlist mappings %s: %v", path, err)
+	}
+	return m, nil
+}
+
+func (m *playlistMappings) Get(uri string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.mappings[uri]
+	return id, ok
+}
+
+// Records a mapping and writes the mappings to disk
+func (m *playlistMappings) Set(uri string, playlistId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mappings[uri] = playlistId
+
+	data, err := json.MarshalIndent(m.mappings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling playlist mappings: %v", err)
+	}
+	if err := writeFileAtomic(m.path, data); err != nil {
+		return fmt.Errorf("Error writing playlist mappings: %v", err)
+	}
+	return nil
+}
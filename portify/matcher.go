@@ -0,0 +1,290 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// How many search results are considered when matching a track
+	matchCandidates = 10
+	// Candidates scoring below this are not considered a match at all
+	minMatchConfidence = 0.35
+	// Matches scoring below this are reported as low confidence
+	lowMatchConfidence = 0.7
+	// Karaoke, cover and tribute versions of a track that isn't one itself
+	// keep this much of their confidence
+	karaokePenalty = 0.3
+)
+
+// Phrases that mark a karaoke, cover or tribute version wherever they appear
+// in its title, artist or album
+var karaokeMarkers = []string{
+	"karaoke",
+	"instrumental",
+	"in the style of",
+	"made famous by",
+	"made popular by",
+	"originally performed by",
+	"as performed by",
+	"tribute",
+	"cover version",
+	"backing track",
+	"sing along",
+	"singalong",
+}
+
+// Words that only mark a cover inside brackets or after a dash, since plenty
+// of titles just contain them, like "Cover Me"
+var bracketedKaraokeMarkers = []string{
+	"cover",
+	"covers",
+}
+
+// Relative weight of each field when scoring a candidate
+const (
+	titleWeight    = 0.45
+	artistWeight   = 0.3
+	albumWeight    = 0.1
+	durationWeight = 0.15
+)
+
+// The fields of a source track a candidate is compared against
+type trackQuery struct {
+	Title    string
+	Artists  []string
+	Album    string
+	Duration time.Duration
+	// The kinds of version the title's qualifiers describe, which are left
+	// out of Title
+	Versions map[string]bool
+	// The source track is a karaoke, cover or tribute version itself
+	Karaoke bool
+}
+
+// A possible match for a track, as returned by a destination's search
+type MatchCandidate struct {
+	Nid        string        `json:"nid"`
+	Artist     string        `json:"artist"`
+	Title      string        `json:"title"`
+	Album      string        `json:"album"`
+	Duration   time.Duration `json:"duration"`
+	BestResult bool          `json:"best_result"`
+	Score      float64       `json:"score"`
+	Explicit   bool          `json:"explicit"`
+	Clean      bool          `json:"clean"`
+}
+
+type scoredCandidate struct {
+	MatchCandidate
+	Confidence float64 `json:"confidence"`
+	Karaoke    bool    `json:"karaoke"`
+}
+
+// Builds a query out of a track's metadata. Tracks without a title are
+// assumed to be named "artist - title". Like candidates, the track is the
+// kinds of version its title and its album's qualifiers describe.
+func newTrackQuery(track BasicTrack) trackQuery {
+	var q trackQuery
+	if track.Title != "" {
+		q = trackQuery{
+			Title:    track.Title,
+			Artists:  track.Artists,
+			Album:    track.Album,
+			Duration: track.Duration,
+		}
+	} else {
+		q = trackQuery{Title: track.Name}
+		if p := strings.SplitN(track.Name, " - ", 2); len(p) == 2 {
+			q.Artists = []string{p[0]}
+			q.Title = p[1]
+		}
+	}
+	q.Karaoke = isKaraoke(q.Title, q.Album, strings.Join(q.Artists, " "))
+	q.Title, q.Versions = parseTitle(q.Title)
+	addAlbumVersions(q.Versions, q.Album)
+	return q
+}
+
+// The text to send to the destination's search
+func (q trackQuery) searchString() string {
+	if len(q.Artists) == 0 {
+		return q.Title
+	}
+	return q.Artists[0] + " " + q.Title
+}
+
+// Orders candidates from best to worst match for the query
+func rankCandidates(q trackQuery, candidates []MatchCandidate) []scoredCandidate {
+	scored := make([]scoredCandidate, len(candidates))
+	for i, c := range candidates {
+		karaoke := isKaraoke(c.Title, c.Album, c.Artist)
+		confidence := scoreCandidate(q, c)
+		if karaoke && !q.Karaoke {
+			confidence *= karaokePenalty
+		}
+		scored[i] = scoredCandidate{c, confidence, karaoke}
+	}
+	sort.Stable(byConfidence(scored))
+	return scored
+}
+
+type byConfidence []scoredCandidate
+
+func (s byConfidence) Len() int      { return len(s) }
+func (s byConfidence) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byConfidence) Less(i, j int) bool {
+	if s[i].Confidence != s[j].Confidence {
+		return s[i].Confidence > s[j].Confidence
+	}
+	return s[i].Score > s[j].Score
+}
+
+// Returns how confident we are that the candidate is the queried track, from
+// 0 to 1. Fields missing on either side don't count towards the score.
+func scoreCandidate(q trackQuery, c MatchCandidate) float64 {
+	title, versions := candidateVersions(c)
+	score := titleWeight * similarity(q.Title, title)
+	total := titleWeight
+
+	if len(q.Artists) > 0 && c.Artist != "" {
+		best := similarity(strings.Join(q.Artists, " "), c.Artist)
+		for _, artist := range q.Artists {
+			best = math.Max(best, similarity(artist, c.Artist))
+		}
+		score += artistWeight * best
+		total += artistWeight
+	}
+
+	if q.Album != "" && c.Album != "" {
+		score += albumWeight * similarity(q.Album, c.Album)
+		total += albumWeight
+	}
+
+	if q.Duration > 0 && c.Duration > 0 {
+		score += durationWeight * durationSimilarity(q.Duration, c.Duration)
+		total += durationWeight
+	}
+
+	confidence := score / total * versionAgreement(q.Versions, versions)
+	if c.BestResult {
+		confidence += 0.05
+	}
+	return math.Min(confidence, 1)
+}
+
+// Returns the core title of a candidate and the kinds of version it is,
+// going by its title, its album's qualifiers and its explicit flags
+func candidateVersions(c MatchCandidate) (string, map[string]bool) {
+	title, versions := parseTitle(c.Title)
+	addAlbumVersions(versions, c.Album)
+	if c.Explicit {
+		versions[versionExplicit] = true
+	}
+	if c.Clean {
+		versions[versionClean] = true
+	}
+	return title, versions
+}
+
+// Whether any of the texts describing a track marks it as a karaoke, cover
+// or tribute version
+func isKaraoke(texts ...string) bool {
+	for _, text := range texts {
+		words := " " + strings.Join(strings.Fields(normalize(text)), " ") + " "
+		for _, marker := range karaokeMarkers {
+			if strings.Contains(words, " "+marker+" ") {
+				return true
+			}
+		}
+
+		for _, part := range qualifiers(text) {
+			words := " " + strings.Join(strings.Fields(normalize(part)), " ") + " "
+			for _, marker := range bracketedKaraokeMarkers {
+				if strings.Contains(words, " "+marker+" ") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Returns the parts of a title that qualify it rather than name it: the text
+// inside brackets and after " - "
+func qualifiers(title string) []string {
+	parts := []string{}
+	depth := 0
+	start := 0
+	for i, r := range title {
+		switch r {
+		case '(', '[':
+			if depth == 0 {
+				start = i + 1
+			}
+			depth++
+		case ')', ']':
+			if depth > 0 {
+				depth--
+				if depth == 0 {
+					parts = append(parts, title[start:i])
+				}
+			}
+		}
+	}
+	if p := strings.SplitN(title, " - ", 2); len(p) == 2 {
+		parts = append(parts, p[1])
+	}
+	return parts
+}
+
+// Full marks within a couple of seconds, nothing once 30 seconds apart
+func durationSimilarity(a, b time.Duration) float64 {
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff <= 2*time.Second {
+		return 1
+	}
+	return math.Max(0, 1-float64(diff-2*time.Second)/float64(28*time.Second))
+}
+
+// Compares the words of two strings, ignoring case and punctuation
+func similarity(a, b string) float64 {
+	wordsA := strings.Fields(normalize(a))
+	wordsB := strings.Fields(normalize(b))
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+	if strings.Join(wordsA, " ") == strings.Join(wordsB, " ") {
+		return 1
+	}
+
+	counts := make(map[string]int)
+	for _, w := range wordsA {
+		counts[w]++
+	}
+	common := 0
+	for _, w := range wordsB {
+		if counts[w] > 0 {
+			counts[w]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(wordsA)+len(wordsB))
+}
+
+func normalize(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "&", " and ", -1)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, s)
+}
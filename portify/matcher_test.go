@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"Hey Jude", "Hey Jude", 1},
+		{"hey jude", "HEY JUDE!", 1},
+		{"Simon & Garfunkel", "Simon and Garfunkel", 1},
+		{"Hey Jude", "Hey", 2.0 / 3},
+		{"Hey Jude", "Let It Be", 0},
+		{"", "Hey Jude", 0},
+		{"Hey Jude", "", 0},
+	}
+	for _, test := range tests {
+		if got := similarity(test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestDurationSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b time.Duration
+		want float64
+	}{
+		{200 * time.Second, 200 * time.Second, 1},
+		{200 * time.Second, 202 * time.Second, 1},
+		{200 * time.Second, 216 * time.Second, 0.5},
+		{216 * time.Second, 200 * time.Second, 0.5},
+		{200 * time.Second, 230 * time.Second, 0},
+		{200 * time.Second, 400 * time.Second, 0},
+	}
+	for _, test := range tests {
+		if got := durationSimilarity(test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("durationSimilarity(%s, %s) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestScoreCandidate(t *testing.T) {
+	query := trackQuery{
+		Title:    "Hey Jude",
+		Artists:  []string{"The Beatles"},
+		Album:    "1",
+		Duration: 431 * time.Second,
+	}
+	tests := []struct {
+		name      string
+		candidate MatchCandidate
+		min, max  float64
+	}{
+		{"exact", MatchCandidate{Title: "Hey Jude", Artist: "The Beatles", Album: "1", Duration: 431 * time.Second}, 1, 1},
+		{"missing fields don't count", MatchCandidate{Title: "Hey Jude", Artist: "The Beatles"}, 1, 1},
+		{"other album", MatchCandidate{Title: "Hey Jude", Artist: "The Beatles", Album: "Past Masters", Duration: 431 * time.Second}, 0.85, 0.95},
+		{"other artist", MatchCandidate{Title: "Hey Jude", Artist: "Wilson Pickett", Duration: 250 * time.Second}, 0.45, 0.55},
+		{"other song", MatchCandidate{Title: "Let It Be", Artist: "The Beatles", Album: "Let It Be", Duration: 243 * time.Second}, 0.3, 0.4},
+		{"best result bonus", MatchCandidate{Title: "Hey Jude", Artist: "Wilson Pickett", Duration: 250 * time.Second, BestResult: true}, 0.5, 0.6},
+		{"capped at 1", MatchCandidate{Title: "Hey Jude", Artist: "The Beatles", BestResult: true}, 1, 1},
+	}
+	for _, test := range tests {
+		got := scoreCandidate(query, test.candidate)
+		if got < test.min-1e-9 || got > test.max+1e-9 {
+			t.Errorf("%s: scoreCandidate = %.3f, want between %.2f and %.2f", test.name, got, test.min, test.max)
+		}
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		track      BasicTrack
+		candidates []MatchCandidate
+		want       []string
+	}{
+		{
+			name: "closest metadata first",
+			track: BasicTrack{
+				Title:    "Yellow",
+				Artists:  []string{"Coldplay"},
+				Album:    "Parachutes",
+				Duration: 269 * time.Second,
+			},
+			candidates: []MatchCandidate{
+				{Nid: "other-song", Title: "Clocks", Artist: "Coldplay", Album: "A Rush of Blood to the Head", Duration: 307 * time.Second},
+				{Nid: "other-artist", Title: "Yellow", Artist: "Kelly Clarkson", Duration: 221 * time.Second},
+				{Nid: "original", Title: "Yellow", Artist: "Coldplay", Album: "Parachutes", Duration: 269 * time.Second},
+			},
+			want: []string{"original", "other-artist", "other-song"},
+		},
+		{
+			name:  "karaoke versions last",
+			track: BasicTrack{Title: "Yellow", Artists: []string{"Coldplay"}},
+			candidates: []MatchCandidate{
+				{Nid: "karaoke", Title: "Yellow (Karaoke Version)", Artist: "Coldplay"},
+				{Nid: "other-artist", Title: "Yellow", Artist: "Kelly Clarkson"},
+				{Nid: "original", Title: "Yellow", Artist: "Coldplay"},
+			},
+			want: []string{"original", "other-artist", "karaoke"},
+		},
+		{
+			name:  "matching version first",
+			track: BasicTrack{Title: "Yellow - Live in Buenos Aires", Artists: []string{"Coldplay"}},
+			candidates: []MatchCandidate{
+				{Nid: "studio", Title: "Yellow", Artist: "Coldplay"},
+				{Nid: "live", Title: "Yellow (Live)", Artist: "Coldplay"},
+			},
+			want: []string{"live", "studio"},
+		},
+		{
+			name:  "search score breaks ties",
+			track: BasicTrack{Name: "Coldplay - Yellow"},
+			candidates: []MatchCandidate{
+				{Nid: "low", Title: "Yellow", Artist: "Coldplay", Score: 10},
+				{Nid: "high", Title: "Yellow", Artist: "Coldplay", Score: 90},
+			},
+			want: []string{"high", "low"},
+		},
+	}
+	for _, test := range tests {
+		ranked := rankCandidates(newTrackQuery(test.track), test.candidates)
+		if len(ranked) != len(test.want) {
+			t.Errorf("%s: got %d candidates, want %d", test.name, len(ranked), len(test.want))
+			continue
+		}
+		for i, nid := range test.want {
+			if ranked[i].Nid != nid {
+				t.Errorf("%s: candidate %d is %s (%.3f), want %s", test.name, i, ranked[i].Nid, ranked[i].Confidence, nid)
+			}
+		}
+	}
+}
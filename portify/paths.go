@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+)
+
+// Where portify keeps the state it needs between runs
+type Paths struct {
+	MatchCache       string
+	Journals         string
+	PlaylistMappings string
+	Reports          string
+	Uploads          string
+	GoogleToken      string
+}
+
+var defaultPaths = Paths{
+	MatchCache:       "tmp/match_cache.json",
+	Journals:         "tmp/journals",
+	PlaylistMappings: "tmp/playlist_mappings.json",
+	Reports:          "tmp/reports",
+	Uploads:          "tmp/uploads",
+	GoogleToken:      "tmp/google_token",
+}
+
+func (p *Paths) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&p.MatchCache, "match-cache", defaultPaths.MatchCache, "File remembering previously matched tracks")
+	flags.StringVar(&p.Journals, "journal-dir", defaultPaths.Journals, "Directory holding the checkpoint journal of every transfer")
+	flags.StringVar(&p.PlaylistMappings, "playlist-mappings", defaultPaths.PlaylistMappings, "File remembering which destination playlist each source playlist was copied to")
+	flags.StringVar(&p.Reports, "report-dir", defaultPaths.Reports, "Directory the unmatched tracks report of every transfer is written to")
+	flags.StringVar(&p.Uploads, "upload-dir", defaultPaths.Uploads, "Directory uploaded playlist files are kept in")
+	flags.StringVar(&p.GoogleToken, "google-token", defaultPaths.GoogleToken, "Encrypted file keeping the Google login between runs")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket shared by everything that talks to a rate limited service
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second, unlimited when <= 0
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{}
+	l.SetLimit(rate, burst)
+	return l
+}
+
+// Changes the rate and burst size, starting again from a full bucket
+func (l *rateLimiter) SetLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+	l.tokens = l.burst
+	l.last = time.Now()
+}
+
+// Blocks until a token is available or cancel is closed. Returns whether
+// the token may be used.
+func (l *rateLimiter) Wait(cancel <-chan struct{}) bool {
+	d := l.reserve()
+	if d == 0 {
+		return !isClosed(cancel)
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// Takes a token, returning how long to wait before it may be used
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Formats the unmatched tracks report can be written in
+const (
+	reportCSV  = "csv"
+	reportJSON = "json"
+)
+
+var reportColumns = []string{
+	"playlist", "playlist_uri", "position", "spotify_uri", "artist", "title", "album",
+	"status", "confidence", "google_nid", "google_artist", "google_title", "google_album", "error",
+}
+
+// Keeps the tracks of every playlist that need someone to look at them:
+// those that weren't found, were rejected, or were matched with low
+// confidence, or were never looked up. Playlists without any such track are
+// left out, unless the transfer never started them.
+func unmatchedTracks(report []*PlaylistReport) []*PlaylistReport {
+	unmatched := []*PlaylistReport{}
+	for _, playlist := range report {
+		tracks := []TrackMatch{}
+		for _, match := range playlist.Tracks {
+			if match.Status == "" {
+				match.Status = matchSkipped
+			}
+			if match.Status != matchFound {
+				tracks = append(tracks, match)
+			}
+		}
+		if len(tracks) > 0 || playlist.NotStarted {
+			unmatched = append(unmatched, &PlaylistReport{Playlist: playlist.Playlist, Tracks: tracks, NotStarted: playlist.NotStarted})
+		}
+	}
+	return unmatched
+}
+
+// Writes a report in the given format
+func writeReport(w io.Writer, report []*PlaylistReport, format string) error {
+	switch format {
+	case reportCSV:
+		return writeReportCSV(w, report)
+	case reportJSON:
+		return writeReportJSON(w, report)
+	}
+	return fmt.Errorf("Unknown report format %q", format)
+}
+
+// Writes a report as CSV, one row per track. A playlist that was never
+// started gets a single skipped row standing for all its tracks.
+func writeReportCSV(w io.Writer, report []*PlaylistReport) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(reportColumns); err != nil {
+		return err
+	}
+	for _, playlist := range report {
+		if playlist.NotStarted {
+			err := out.Write([]string{
+				playlist.Playlist.Name,
+				playlist.Playlist.Uri,
+				"", "", "", "", "",
+				matchSkipped,
+				"", "", "", "", "",
+				"The transfer stopped before this playlist",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, match := range playlist.Tracks {
+			confidence := ""
+			if match.Found {
+				confidence = strconv.FormatFloat(match.Confidence, 'f', 2, 64)
+			}
+			err := out.Write([]string{
+				playlist.Playlist.Name,
+				playlist.Playlist.Uri,
+				strconv.Itoa(match.Position + 1),
+				match.SpotifyTrackUri,
+				match.SpotifyArtist,
+				match.SpotifyTitle,
+				match.SpotifyAlbum,
+				match.Status,
+				confidence,
+				match.GoogleNid,
+				match.GoogleArtist,
+				match.GoogleTitle,
+				match.GoogleAlbum,
+				match.Error,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Writes a report as JSON, grouped by playlist
+func writeReportJSON(w io.Writer, report []*PlaylistReport) error {
+	js, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(js)
+	return err
+}
+
+// Writes a report to a file, in CSV if its name ends in .csv and in JSON
+// otherwise
+func writeReportFile(path string, report []*PlaylistReport) error {
+	format := reportJSON
+	if filepath.Ext(path) == ".csv" {
+		format = reportCSV
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Error creating report directory: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating report: %v", err)
+	}
+	if err := writeReport(f, report, format); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing report: %v", err)
+	}
+	return f.Close()
+}
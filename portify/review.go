@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many candidates are offered for each track under review by default
+const reviewCandidates = 5
+
+// A track of a finished transfer that someone should look at, with the
+// destination tracks it could be instead
+type ReviewTrack struct {
+	Playlist   Playlist          `json:"playlist"`
+	Match      TrackMatch        `json:"match"`
+	Candidates []scoredCandidate `json:"candidates"`
+}
+
+type ReviewSearchRequest struct {
+	PlaylistUri string `json:"playlist_uri"`
+	Position    int    `json:"position"`
+	Query       string `json:"query"`
+}
+
+// The destination track picked for the track at a position of a playlist
+type Correction struct {
+	PlaylistUri string `json:"playlist_uri"`
+	Position    int    `json:"position"`
+	Nid         string `json:"nid"`
+	Artist      string `json:"artist"`
+	Title       string `json:"title"`
+	Album       string `json:"album"`
+}
+
+type CorrectRequest struct {
+	Corrections []Correction `json:"corrections"`
+}
+
+// Whether a match needs reviewing
+func needsReview(match TrackMatch) bool {
+	return match.Status == matchNotFound || match.Status == matchLowConfidence || match.Status == matchAddFailed
+}
+
+// Rebuilds the query a match was searched with from what the match
+// remembers of the source track
+func matchQuery(match TrackMatch) trackQuery {
+	if match.SpotifyTitle == "" {
+		return newTrackQuery(BasicTrack{Name: match.SpotifyTrackName})
+	}
+	q := trackQuery{Title: match.SpotifyTitle, Album: match.SpotifyAlbum}
+	if match.SpotifyArtist != "" {
+		q.Artists = []string{match.SpotifyArtist}
+	}
+	q.Karaoke = isKaraoke(q.Title, q.Album, match.SpotifyArtist)
+	q.Title, q.Versions = parseTitle(q.Title)
+	addAlbumVersions(q.Versions, q.Album)
+	return q
+}
+
+// Lists the tracks of a transfer that need reviewing, each with the best
+// candidates the destination has for it, searched for like the transfer did.
+// reviewSearch is there for the tracks none of them fit.
+func reviewTracks(journal *Journal, dst ReviewDestination, limit int) ([]ReviewTrack, error) {
+	tracks := []ReviewTrack{}
+	for _, playlist := range journal.Playlists {
+		entry, ok := journal.Entries[playlist.Uri]
+		if !ok {
+			continue
+		}
+		for _, match := range entry.Matches {
+			if !needsReview(match) {
+				continue
+			}
+			query := matchQuery(match)
+			candidates, err := dst.Candidates(query, query.searchString(), nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(candidates) > limit {
+				candidates = candidates[:limit]
+			}
+			tracks = append(tracks, ReviewTrack{Playlist: playlist, Match: match, Candidates: candidates})
+		}
+	}
+	return tracks, nil
+}
+
+// Puts the corrected tracks of a playlist in its destination copy, where
+// they are in the source playlist. Tracks that were added with low
+// confidence are replaced. The journal is updated after every change to the
+// playlist, so retrying after a failure doesn't insert anything twice.
+func applyCorrections(dst ReviewDestination, journal *Journal, entry *JournalPlaylist, corrections []Correction, cache *matchCache) error {
+	// Skip what an earlier attempt already put in place
+	pending := []Correction{}
+	for _, c := range corrections {
+		match := entry.Matches[c.Position]
+		if !(match.Corrected && match.Status == matchFound && match.GoogleNid == c.Nid) {
+			pending = append(pending, c)
+		}
+	}
+	corrections = pending
+	if len(corrections) == 0 {
+		return nil
+	}
+
+	playlistId := entry.DestinationId
+	entries, err := dst.PlaylistEntries(playlistId)
+	if err != nil {
+		return err
+	}
+
+	// The entries of the playlist are the tracks that were added, in order
+	added := []int{}
+	for _, match := range entry.Matches {
+		if match.Found && match.Status != matchAddFailed {
+			added = append(added, match.Position)
+		}
+	}
+	if len(added) != len(entries) {
+		// The playlist was edited since, so positions can't be trusted
+		fmt.Printf("Playlist %s changed since the transfer, appending corrections\n", playlistId)
+		songIds := []string{}
+		for _, c := range corrections {
+			songIds = append(songIds, c.Nid)
+		}
+		err := dst.AddTracks(playlistId, songIds, nil)
+		if mutationErr, ok := err.(*MutationError); ok {
+			if err := recordCorrections(journal, entry, withoutFailures(corrections, mutationErr.Failures), cache); err != nil {
+				return err
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		return recordCorrections(journal, entry, corrections, cache)
+	}
+
+	corrected := make(map[int]bool)
+	for _, c := range corrections {
+		corrected[c.Position] = true
+	}
+	removed := []string{}
+	removedPositions := []int{}
+	kept := []int{}
+	for i, position := range added {
+		if corrected[position] {
+			removed = append(removed, entries[i].Id)
+			removedPositions = append(removedPositions, position)
+		} else {
+			kept = append(kept, i)
+		}
+	}
+	if len(removed) > 0 {
+		if err := dst.RemoveEntries(removed); err != nil {
+			return err
+		}
+		// Until their corrections are in, the replaced tracks are missing
+		err := journal.update(entry, func(entry *JournalPlaylist) {
+			for _, position := range removedPositions {
+				match := &entry.Matches[position]
+				match.Found = false
+				match.Status = matchNotFound
+				match.Error = "Removed to be corrected"
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Corrections between the same two remaining entries go in together
+	sort.Sort(byPosition(corrections))
+	for start := 0; start < len(corrections); {
+		k := sort.Search(len(kept), func(i int) bool { return added[kept[i]] > corrections[start].Position })
+		end := start
+		songIds := []string{}
+		for end < len(corrections) && (k == len(kept) || corrections[end].Position < added[kept[k]]) {
+			songIds = append(songIds, corrections[end].Nid)
+			end++
+		}
+
+		preceding, following := "", ""
+		if k > 0 {
+			preceding = entries[kept[k-1]].Id
+		}
+		if k < len(kept) {
+			following = entries[kept[k]].Id
+		}
+		err := dst.InsertTracks(playlistId, songIds, preceding, following)
+		if mutationErr, ok := err.(*MutationError); ok {
+			// Keep the ones that went in, only the rejected ones are retried
+			if err := recordCorrections(journal, entry, withoutFailures(corrections[start:end], mutationErr.Failures), cache); err != nil {
+				return err
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if err := recordCorrections(journal, entry, corrections[start:end], cache); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// Leaves out the corrections whose tracks were rejected
+func withoutFailures(corrections []Correction, failures []MutationFailure) []Correction {
+	rejected := make(map[string]int)
+	for _, failure := range failures {
+		rejected[failure.TrackId]++
+	}
+	kept := []Correction{}
+	for _, c := range corrections {
+		if rejected[c.Nid] > 0 {
+			rejected[c.Nid]--
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// Remembers corrections that were put in place in the journal, and in the
+// match cache for future transfers
+func recordCorrections(journal *Journal, entry *JournalPlaylist, corrections []Correction, cache *matchCache) error {
+	return journal.update(entry, func(entry *JournalPlaylist) {
+		for _, c := range corrections {
+			match := &entry.Matches[c.Position]
+			match.Found = true
+			match.Status = matchFound
+			match.Confidence = 1
+			match.GoogleNid = c.Nid
+			match.GoogleArtist = c.Artist
+			match.GoogleTitle = c.Title
+			match.GoogleAlbum = c.Album
+			match.Error = ""
+			match.Corrected = true
+			cache.Put(match.SpotifyTrackUri, CachedMatch{
+				Nid:        c.Nid,
+				Artist:     c.Artist,
+				Title:      c.Title,
+				Album:      c.Album,
+				Confidence: 1,
+				Matched:    time.Now(),
+				Corrected:  true,
+			})
+		}
+	})
+}
+
+type byPosition []Correction
+
+func (s byPosition) Len() int           { return len(s) }
+func (s byPosition) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPosition) Less(i, j int) bool { return s[i].Position < s[j].Position }
+
+// Loads the journal of a transfer to review, along with the destination it
+// went to. Returns the error response to send instead if it can't be
+// reviewed.
+func (s *Server) reviewJournal(id string) (*Journal, ReviewDestination, *Response) {
+	if j, ok := s.jobs.get(id); ok && !j.isFinished() {
+		return nil, nil, &Response{Status: 409, Message: "Transfer is still running."}
+	}
+	journal, err := loadJournal(s.paths.Journals, id)
+	if err != nil {
+		return nil, nil, &Response{Status: 404, Message: err.Error()}
+	}
+
+	dst, err := s.destination(journal.Destination)
+	if err != nil {
+		return nil, nil, &Response{Status: 400, Message: err.Error()}
+	}
+	reviewDst, ok := dst.(ReviewDestination)
+	if !ok {
+		return nil, nil, &Response{Status: 400, Message: fmt.Sprintf("Transfers to %s can't be reviewed.", journal.Destination)}
+	}
+	if !dst.LoggedIn() {
+		return nil, nil, notLoggedIn(401, journal.Destination)
+	}
+	return journal, reviewDst, nil
+}
+
+// Serves GET /portify/review/{id}, which lists the tracks to review, and
+// POST /portify/review/{id}/search and /correct
+func (s *Server) reviewHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/portify/review/"), "/")
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if len(parts) > 2 || (len(parts) == 2 && action != "search" && action != "correct") {
+		http.NotFound(w, r)
+		return
+	}
+	if action != "" && r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Use a POST to %s", action), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if action == "correct" {
+		// Corrections each change the journal, so they are made one at a
+		// time, each with the journal as the previous one left it
+		s.reviewMu.Lock()
+		defer s.reviewMu.Unlock()
+	}
+
+	journal, dst, response := s.reviewJournal(parts[0])
+	if response == nil {
+		switch action {
+		case "":
+			response = reviewList(journal, dst, r)
+		case "search":
+			var searchReq ReviewSearchRequest
+			if err := json.NewDecoder(r.Body).Decode(&searchReq); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid search specified: %s", err), http.StatusBadRequest)
+				return
+			}
+			response = s.reviewSearch(journal, dst, &searchReq)
+		case "correct":
+			var correctReq CorrectRequest
+			if err := json.NewDecoder(r.Body).Decode(&correctReq); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid corrections specified: %s", err), http.StatusBadRequest)
+				return
+			}
+			response = s.reviewCorrect(journal, dst, &correctReq)
+		}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Lists the tracks to review with up to ?candidates= candidates each
+func reviewList(journal *Journal, dst ReviewDestination, r *http.Request) *Response {
+	limit := reviewCandidates
+	if n, err := strconv.Atoi(r.URL.Query().Get("candidates")); err == nil && n > 0 {
+		limit = n
+	}
+	tracks, err := reviewTracks(journal, dst, limit)
+	if isAuthError(err) {
+		return &Response{Status: 401, Message: err.Error()}
+	} else if err != nil {
+		return &Response{Status: 500, Message: err.Error()}
+	}
+	return &Response{Status: 200, Message: "ok", Data: tracks}
+}
+
+// Searches for candidates for the track being reviewed, ranking them against
+// it. Without a query the user typed, searches like the transfer did.
+func (s *Server) reviewSearch(journal *Journal, dst ReviewDestination, searchReq *ReviewSearchRequest) *Response {
+	entry, ok := journal.Entries[searchReq.PlaylistUri]
+	if !ok || searchReq.Position < 0 || searchReq.Position >= len(entry.Matches) {
+		return &Response{Status: 404, Message: "No such track in the transfer."}
+	}
+
+	query := matchQuery(entry.Matches[searchReq.Position])
+	search := strings.TrimSpace(searchReq.Query)
+	if search == "" {
+		search = query.searchString()
+	}
+	candidates, err := dst.Candidates(query, search, nil)
+	if isAuthError(err) {
+		return &Response{Status: 401, Message: err.Error()}
+	} else if err != nil {
+		return &Response{Status: 500, Message: err.Error()}
+	}
+	return &Response{Status: 200, Message: "ok", Data: candidates}
+}
+
+// Adds the picked tracks to the destination playlists, and remembers them
+// in the journal and for future transfers
+func (s *Server) reviewCorrect(journal *Journal, dst ReviewDestination, correctReq *CorrectRequest) *Response {
+	byPlaylist := make(map[string][]Correction)
+	seen := make(map[string]bool)
+	for _, c := range correctReq.Corrections {
+		key := fmt.Sprintf("%s:%d", c.PlaylistUri, c.Position)
+		if seen[key] {
+			return &Response{Status: 400, Message: "Every track can only be corrected once."}
+		}
+		seen[key] = true
+
+		entry, ok := journal.Entries[c.PlaylistUri]
+		if !ok || c.Position < 0 || c.Position >= len(entry.Matches) {
+			return &Response{Status: 404, Message: "No such track in the transfer."}
+		}
+		if entry.DestinationId == "" {
+			return &Response{Status: 400, Message: fmt.Sprintf("'%s' wasn't created yet.", entry.Name)}
+		}
+		if c.Nid == "" {
+			return &Response{Status: 400, Message: "Please pick a track for every correction."}
+		}
+		byPlaylist[c.PlaylistUri] = append(byPlaylist[c.PlaylistUri], c)
+	}
+
+	// Whatever was put in place is remembered, even if a later playlist fails
+	defer func() {
+		if err := s.cache.Save(); err != nil {
+			fmt.Printf("Couldn't save match cache: %v\n", err)
+		}
+	}()
+
+	for _, playlist := range journal.Playlists {
+		corrections, ok := byPlaylist[playlist.Uri]
+		if !ok {
+			continue
+		}
+		entry := journal.Entries[playlist.Uri]
+		err := applyCorrections(dst, journal, entry, corrections, s.cache)
+		if j, ok := s.jobs.get(journal.ID); ok {
+			j.t.replaceMatches(playlist.Uri, entry.Matches)
+		}
+		if isAuthError(err) {
+			return &Response{Status: 401, Message: err.Error()}
+		} else if err != nil {
+			return &Response{Status: 500, Message: fmt.Sprintf("Error correcting '%s': %v", entry.Name, err)}
+		}
+	}
+
+	return &Response{Status: 200, Message: fmt.Sprintf("%d tracks corrected.", len(correctReq.Corrections))}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A destination offering the same numbered candidates for every search
+type fakeReviewDestination struct {
+	*fakeDestination
+	searches []string
+}
+
+func (d *fakeReviewDestination) Candidates(query trackQuery, search string, cancel <-chan struct{}) ([]scoredCandidate, error) {
+	d.searches = append(d.searches, search)
+	candidates := []scoredCandidate{}
+	for i := 0; i < 8; i++ {
+		candidates = append(candidates, scoredCandidate{
+			MatchCandidate: MatchCandidate{Nid: fmt.Sprintf("%s-%d", query.Title, i), Title: query.Title},
+			Confidence:     1 - float64(i)/10,
+		})
+	}
+	return candidates, nil
+}
+
+func (d *fakeReviewDestination) InsertTracks(playlistId string, songIds []string, precedingEntryId string, followingEntryId string) error {
+	return d.AddTracks(playlistId, songIds, nil)
+}
+
+func TestReviewTracks(t *testing.T) {
+	playlist := Playlist{Uri: "playlist", Name: "Playlist"}
+	journal := &Journal{
+		Playlists: []Playlist{playlist},
+		Entries: map[string]*JournalPlaylist{
+			"playlist": {Matches: []TrackMatch{
+				{Position: 0, SpotifyTitle: "Found", SpotifyArtist: "Artist", Found: true, Status: matchFound, GoogleNid: "found"},
+				{Position: 1, SpotifyTitle: "Missing", SpotifyArtist: "Artist", Status: matchNotFound},
+				{Position: 2, SpotifyTitle: "Unsure", SpotifyArtist: "Artist", Found: true, Status: matchLowConfidence, GoogleNid: "unsure"},
+			}},
+		},
+	}
+	dst := &fakeReviewDestination{fakeDestination: newFakeDestination()}
+
+	tracks, err := reviewTracks(journal, dst, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("got %d tracks to review, want 2", len(tracks))
+	}
+	for i, title := range []string{"Missing", "Unsure"} {
+		track := tracks[i]
+		if track.Match.SpotifyTitle != title {
+			t.Errorf("track %d is %q, want %q", i, track.Match.SpotifyTitle, title)
+		}
+		if len(track.Candidates) != 3 {
+			t.Errorf("%s: got %d candidates, want 3", title, len(track.Candidates))
+			continue
+		}
+		if track.Candidates[0].Nid != title+"-0" {
+			t.Errorf("%s: best candidate is %s, want %s", title, track.Candidates[0].Nid, title+"-0")
+		}
+	}
+	if len(dst.searches) != 2 || dst.searches[0] != "Artist Missing" {
+		t.Errorf("searched for %q, want the tracks under review like a transfer", dst.searches)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultSource      = "spotify"
+	defaultDestination = "google"
+)
+
+// A Source is a music service that playlists are read from. Closing cancel
+// stops PlaylistTracks, which then closes the channel early.
+type Source interface {
+	LoggedIn() bool
+	AllPlaylists() []Playlist
+	PlaylistTracks(playlist *Playlist, cancel <-chan struct{}) (chan BasicTrack, int)
+}
+
+// A Destination is a music service that playlists are written to. Closing
+// cancel abandons FindBestTrack with errCancelled. AddTracks calls batchDone,
+// unless it is nil, after each batch of tracks it sends.
+type Destination interface {
+	LoggedIn() bool
+	FindBestTrack(track BasicTrack, cancel <-chan struct{}) (*RelevantTrack, error)
+	CreatePlaylist(name string, public bool) (string, error)
+	AddTracks(playlistId string, songIds []string, batchDone batchFunc) error
+}
+
+// Told after every batch of tracks added to a playlist how many of them were
+// sent so far, and which tracks of the batch were rejected. Returning an
+// error stops adding the rest, and is returned.
+type batchFunc func(sent int, rejected []MutationFailure) error
+
+// A Destination whose existing playlists can be updated in place
+type SyncDestination interface {
+	Destination
+	PlaylistEntries(playlistId string) ([]PlaylistEntry, error)
+	RemoveEntries(entryIds []string) error
+}
+
+// A Destination that can list the candidates for a track so the user can
+// pick the right one, and insert tracks in the middle of a playlist. Tracks
+// inserted without a preceding entry go right before the following one,
+// without a following entry right after the preceding one, and without
+// either at the end, like AddTracks.
+type ReviewDestination interface {
+	SyncDestination
+	Candidates(query trackQuery, search string, cancel <-chan struct{}) ([]scoredCandidate, error)
+	InsertTracks(playlistId string, songIds []string, precedingEntryId string, followingEntryId string) error
+}
+
+// A Destination that can mark tracks as liked, for source playlists that
+// mean that rather than being a playlist, like Spotify's starred tracks
+type RatingDestination interface {
+	Destination
+	ThumbsUp(tracks []RelevantTrack, addToLibrary bool) error
+}
+
+// Refuses to transfer the playlists of a service into itself. Its tracks
+// would be searched for in its own catalog, and the playlists duplicated
+// with guesses in place of uploaded tracks.
+func checkTransferServices(source string, destination string) error {
+	if source == destination {
+		return fmt.Errorf("Playlists can't be transferred from %s to itself, export them instead", source)
+	}
+	return nil
+}
+
+// The error response for a service that isn't logged in, naming it the way
+// errors from the services do
+func notLoggedIn(status int, name string) *Response {
+	return &Response{Status: status, Message: fmt.Sprintf("%s: not logged in.", strings.Title(name))}
+}
+
+// Looks up a registered source by name, falling back to the default
+func (s *Server) source(name string) (Source, error) {
+	if name == "" {
+		name = defaultSource
+	}
+	src, ok := s.sources[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown source %q", name)
+	}
+	return src, nil
+}
+
+// Looks up a registered destination by name, falling back to the default
+func (s *Server) destination(name string) (Destination, error) {
+	if name == "" {
+		name = defaultDestination
+	}
+	dst, ok := s.destinations[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown destination %q", name)
+	}
+	return dst, nil
+}
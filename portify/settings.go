@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Tunables shared by every transfer
+type Settings struct {
+	// How many tracks of a playlist are matched at once
+	Workers int `json:"workers"`
+	// How many requests per second may be sent to Google, 0 for no limit
+	GoogleRequestsPerSecond float64 `json:"google_requests_per_second"`
+	// How many requests may be sent to Google in a burst
+	GoogleBurst int `json:"google_burst"`
+	// Template naming the Google copy of a playlist, given the Spotify
+	// playlist with its folders
+	PlaylistNameTemplate string `json:"playlist_name_template"`
+}
+
+var defaultSettings = Settings{
+	Workers:                 8,
+	GoogleRequestsPerSecond: 5,
+	GoogleBurst:             10,
+	PlaylistNameTemplate:    defaultPlaylistNameTemplate,
+}
+
+func (st Settings) validate() error {
+	if st.Workers < 1 {
+		return fmt.Errorf("At least one worker is required")
+	}
+	if st.GoogleRequestsPerSecond < 0 {
+		return fmt.Errorf("The request rate can't be negative")
+	}
+	if st.GoogleBurst < 1 {
+		return fmt.Errorf("The burst size must be at least 1")
+	}
+	if _, err := parsePlaylistNameTemplate(st.PlaylistNameTemplate); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) currentSettings() Settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings
+}
+
+func (s *Server) applySettings(st Settings) error {
+	if err := st.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.settings = st
+	s.mu.Unlock()
+	s.goog.SetRateLimit(st.GoogleRequestsPerSecond, st.GoogleBurst)
+	return nil
+}
+
+// Returns the current settings on GET, and replaces them on POST
+func (s *Server) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	var response *Response
+
+	if r.Method == "POST" {
+		st := s.currentSettings()
+		err := json.NewDecoder(r.Body).Decode(&st)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid settings specified: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.applySettings(st); err != nil {
+			response = &Response{Status: 400, Message: err.Error()}
+		}
+	}
+
+	if response == nil {
+		response = &Response{Status: 200, Message: "ok", Data: s.currentSettings()}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
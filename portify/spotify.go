@@ -17,13 +17,28 @@ type Spotify struct {
 type Playlist struct {
 	Uri  string `json:"uri"`
 	Name string `json:"name"`
+	// Names of the folders the playlist is in, outermost first
+	Folders []string `json:"folders,omitempty"`
 }
 
 type BasicTrack struct {
-	Uri  string `json:"uri"`
-	Name string `json:"name"`
+	Uri         string        `json:"uri"`
+	Name        string        `json:"name"`
+	Title       string        `json:"title"`
+	Artists     []string      `json:"artists"`
+	Album       string        `json:"album"`
+	AlbumArtist string        `json:"album_artist"`
+	Duration    time.Duration `json:"duration"`
+	Disc        int           `json:"disc"`
+	Index       int           `json:"index"`
+	Popularity  int           `json:"popularity"`
+	IsLocal     bool          `json:"is_local"`
+	Available   bool          `json:"available"`
 }
 
+// The URI standing for the starred tracks, which aren't a real playlist
+const starredPlaylistUri = "starred"
+
 func NewSpotify() (*Spotify, error) {
 	appKey, err := Asset("spotify_appkey.key")
 	// appKey, err := ioutil.ReadFile("spotify_appkey.key")
@@ -120,20 +135,33 @@ func (sp *Spotify) AllPlaylists() []Playlist {
 	}
 	playlistContainer.Wait()
 
-	playlists := []Playlist{Playlist{ "starred", "Starred Tracks", },}
+	playlists := []Playlist{Playlist{Uri: starredPlaylistUri, Name: "Starred Tracks"}}
 
+	// Folders are marked by a start and an end entry around their playlists
+	folders := []string{}
 	for i := 0; i < playlistContainer.Playlists(); i++ {
 		switch playlistContainer.PlaylistType(i) {
 		case spotify.PlaylistTypeStartFolder:
+			folder, err := playlistContainer.Folder(i)
+			if err != nil {
+				fmt.Printf("Couldn't read playlist folder: %v\n", err)
+				folders = append(folders, "")
+				continue
+			}
+			folders = append(folders, folder.Name())
 		case spotify.PlaylistTypeEndFolder:
-			// TODO: ?
-			continue
+			if len(folders) > 0 {
+				folders = folders[:len(folders)-1]
+			}
 		case spotify.PlaylistTypePlaylist:
 			playlist := playlistContainer.Playlist(i)
 			playlist.Wait()
 			p := Playlist{
-				playlist.Link().String(),
-				playlist.Name(),
+				Uri:  playlist.Link().String(),
+				Name: playlist.Name(),
+			}
+			if len(folders) > 0 {
+				p.Folders = append([]string(nil), folders...)
 			}
 			playlists = append(playlists, p)
 		}
@@ -142,7 +170,9 @@ func (sp *Spotify) AllPlaylists() []Playlist {
 	return playlists
 }
 
-func (sp *Spotify) PlaylistTracks(wantedPlaylist *Playlist) (chan BasicTrack, int) {
+// Streams the tracks of a playlist as their metadata loads. Closing cancel
+// stops waiting for metadata and closes the channel early.
+func (sp *Spotify) PlaylistTracks(wantedPlaylist *Playlist, cancel <-chan struct{}) (chan BasicTrack, int) {
 
 	playlistContainer, err := sp.session.Playlists()
 	if err != nil {
@@ -150,15 +180,11 @@ func (sp *Spotify) PlaylistTracks(wantedPlaylist *Playlist) (chan BasicTrack, in
 	}
 	playlistContainer.Wait()
 	var selectedPlaylist *spotify.Playlist
-	if wantedPlaylist.Uri == "starred" {
+	if wantedPlaylist.Uri == starredPlaylistUri {
 		selectedPlaylist = sp.session.Starred()
 	} else {
 		for i := 0; i < playlistContainer.Playlists(); i++ {
 			switch playlistContainer.PlaylistType(i) {
-			case spotify.PlaylistTypeStartFolder:
-			case spotify.PlaylistTypeEndFolder:
-				// TODO: ?
-				continue
 			case spotify.PlaylistTypePlaylist:
 				playlist := playlistContainer.Playlist(i)
 				playlist.Wait()
@@ -172,17 +198,88 @@ func (sp *Spotify) PlaylistTracks(wantedPlaylist *Playlist) (chan BasicTrack, in
 
 	ret := make(chan BasicTrack)
 	go func() {
+		defer close(ret)
 		for j := 0; j < selectedPlaylist.Tracks(); j++ {
 			track := selectedPlaylist.Track(j).Track()
-			track.Wait()
-			artist := track.Artist(0)
-			artist.Wait()
-			ret <- BasicTrack{
-				Uri:  track.Link().String(),
-				Name: fmt.Sprintf("%s - %s", artist.Name(), track.Name()),
+			basic, err := newBasicTrack(track, cancel)
+			if err != nil {
+				return
+			}
+			select {
+			case ret <- basic:
+			case <-cancel:
+				return
 			}
 		}
-		close(ret)
 	}()
 	return ret, selectedPlaylist.Tracks()
 }
+
+func newBasicTrack(track *spotify.Track, cancel <-chan struct{}) (BasicTrack, error) {
+	if err := waitLoaded(track, cancel); err != nil {
+		return BasicTrack{}, err
+	}
+	artists := make([]string, track.Artists())
+	for i := range artists {
+		artist := track.Artist(i)
+		if err := waitLoaded(artist, cancel); err != nil {
+			return BasicTrack{}, err
+		}
+		artists[i] = artist.Name()
+	}
+
+	basic := BasicTrack{
+		Uri:        track.Link().String(),
+		Name:       track.Name(),
+		Title:      track.Name(),
+		Artists:    artists,
+		Duration:   track.Duration(),
+		Disc:       track.Disc(),
+		Index:      track.Index(),
+		Popularity: int(track.Popularity()),
+		IsLocal:    track.IsLocal(),
+		Available:  track.Availability() == spotify.TrackAvailabilityAvailable,
+	}
+	if len(artists) > 0 {
+		basic.Name = fmt.Sprintf("%s - %s", artists[0], track.Name())
+	}
+
+	if album := track.Album(); album != nil {
+		if err := waitLoaded(album, cancel); err != nil {
+			return BasicTrack{}, err
+		}
+		basic.Album = album.Name()
+		if albumArtist := album.Artist(); albumArtist != nil {
+			if err := waitLoaded(albumArtist, cancel); err != nil {
+				return BasicTrack{}, err
+			}
+			basic.AlbumArtist = albumArtist.Name()
+		}
+	}
+	return basic, nil
+}
+
+// Metadata that is loaded in the background
+type loader interface {
+	Wait()
+}
+
+// Waits for metadata to load, giving up when cancel is closed. The loading
+// itself can't be stopped, it finishes in the background.
+func waitLoaded(l loader, cancel <-chan struct{}) error {
+	if cancel == nil {
+		l.Wait()
+		return nil
+	}
+	loaded := make(chan struct{})
+	go func() {
+		l.Wait()
+		close(loaded)
+	}()
+	select {
+	case <-loaded:
+		return nil
+	case <-cancel:
+		return errCancelled
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Keeps the Google login in a file encrypted with AES-GCM. The key comes
+// from PORTIFY_TOKEN_KEY if set, or else from a random key file created
+// next to it that only the user can read.
+type tokenStore struct {
+	path    string
+	keyPath string
+}
+
+func newTokenStore(path string) *tokenStore {
+	return &tokenStore{path: path, keyPath: path + ".key"}
+}
+
+// Returns the saved token, or nil if there is none
+func (s *tokenStore) Load() (*Token, error) {
+	sealed, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading Google login: %v", err)
+	}
+
+	aead, err := s.cipher(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Saved Google login is corrupt, please log in again")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decrypt saved Google login, please log in again")
+	}
+
+	var token Token
+	if err := json.Unmarshal(plain, &token); err != nil {
+		return nil, fmt.Errorf("Error parsing Google login: %v", err)
+	}
+	return &token, nil
+}
+
+func (s *tokenStore) Save(token *Token) error {
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	aead, err := s.cipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("Error saving Google login: %v", err)
+	}
+	// Write to a temporary file first so a crash can't leave half a token
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return fmt.Errorf("Error saving Google login: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("Error saving Google login: %v", err)
+	}
+	return nil
+}
+
+// Forgets the saved token
+func (s *tokenStore) Clear() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing Google login: %v", err)
+	}
+	return nil
+}
+
+// Returns the cipher tokens are sealed with, creating the key file if
+// create is set and there is none yet
+func (s *tokenStore) cipher(create bool) (cipher.AEAD, error) {
+	var key []byte
+	if passphrase := os.Getenv("PORTIFY_TOKEN_KEY"); passphrase != "" {
+		sum := sha256.Sum256([]byte(passphrase))
+		key = sum[:]
+	} else {
+		var err error
+		key, err = ioutil.ReadFile(s.keyPath)
+		if os.IsNotExist(err) && create {
+			key, err = s.createKey()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading Google login key: %v", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Google login key %s is invalid", s.keyPath)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *tokenStore) createKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.keyPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(s.keyPath, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
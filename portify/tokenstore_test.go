@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "portify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Sets PORTIFY_TOKEN_KEY, returning a func putting back the old value
+func setTokenKey(key string) func() {
+	old := os.Getenv("PORTIFY_TOKEN_KEY")
+	os.Setenv("PORTIFY_TOKEN_KEY", key)
+	return func() { os.Setenv("PORTIFY_TOKEN_KEY", old) }
+}
+
+func TestTokenStoreRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, key := range []string{"", "passphrase"} {
+		restore := setTokenKey(key)
+		store := newTokenStore(filepath.Join(dir, "google_token"))
+
+		if token, err := store.Load(); token != nil || err != nil {
+			t.Errorf("key %q: empty store returned %+v, %v", key, token, err)
+		}
+		token := &Token{
+			Type:         tokenOAuth,
+			AccessToken:  "access",
+			RefreshToken: "refresh",
+			Expiry:       time.Unix(1400000000, 0),
+		}
+		if err := store.Save(token); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := store.Load()
+		if err != nil {
+			t.Errorf("key %q: %v", key, err)
+		} else if loaded.Expiry = loaded.Expiry.Local(); !reflect.DeepEqual(loaded, token) {
+			t.Errorf("key %q: loaded %+v, want %+v", key, loaded, token)
+		}
+
+		if err := store.Clear(); err != nil {
+			t.Errorf("key %q: %v", key, err)
+		}
+		if token, err := store.Load(); token != nil || err != nil {
+			t.Errorf("key %q: cleared store returned %+v, %v", key, token, err)
+		}
+		restore()
+	}
+}
+
+func TestTokenStoreWrongKey(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := newTokenStore(filepath.Join(dir, "google_token"))
+
+	restore := setTokenKey("right")
+	if err := store.Save(&Token{Type: tokenOAuth, AccessToken: "access"}); err != nil {
+		t.Fatal(err)
+	}
+	setTokenKey("wrong")
+	if token, err := store.Load(); token != nil || err == nil {
+		t.Errorf("loading with the wrong key returned %+v, %v", token, err)
+	}
+	restore()
+
+	// Without PORTIFY_TOKEN_KEY, a key file that doesn't fit
+	defer setTokenKey("")()
+	if err := store.Save(&Token{Type: tokenOAuth, AccessToken: "access"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.keyPath, make([]byte, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := store.Load(); token != nil || err == nil {
+		t.Errorf("loading with another key file returned %+v, %v", token, err)
+	}
+}
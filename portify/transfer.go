@@ -0,0 +1,910 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// An emitter receives the progress events of a transfer
+type emitter interface {
+	Emit(event string, args ...interface{}) error
+}
+
+// Match statuses of a track
+const (
+	matchFound         = "found"
+	matchLowConfidence = "low_confidence"
+	matchNotFound      = "not_found"
+	matchAddFailed     = "add_failed"
+	// The transfer stopped before the track was looked up
+	matchSkipped = "skipped"
+)
+
+// The outcome of looking up a single source track in the destination
+type TrackMatch struct {
+	Position         int     `json:"position"`
+	SpotifyTrackUri  string  `json:"spotify_track_uri"`
+	SpotifyTrackName string  `json:"spotify_track_name"`
+	SpotifyArtist    string  `json:"spotify_artist,omitempty"`
+	SpotifyTitle     string  `json:"spotify_title,omitempty"`
+	SpotifyAlbum     string  `json:"spotify_album,omitempty"`
+	Found            bool    `json:"found"`
+	Status           string  `json:"status"`
+	Confidence       float64 `json:"confidence"`
+	GoogleNid        string  `json:"google_nid,omitempty"`
+	GoogleArtist     string  `json:"google_artist,omitempty"`
+	GoogleTitle      string  `json:"google_title,omitempty"`
+	GoogleAlbum      string  `json:"google_album,omitempty"`
+	Error            string  `json:"error,omitempty"`
+	Corrected        bool    `json:"corrected,omitempty"`
+	// The match is a karaoke or cover version, or only those were found
+	Karaoke bool `json:"karaoke,omitempty"`
+}
+
+// States of a playlist within a transfer
+const (
+	playlistQueued    = "queued"
+	playlistRunning   = "running"
+	playlistDone      = "done"
+	playlistSkipped   = "skipped"
+	playlistFailed    = "failed"
+	playlistCancelled = "cancelled"
+)
+
+// How far a transfer got with one of its playlists
+type PlaylistStatus struct {
+	Playlist      Playlist `json:"playlist"`
+	State         string   `json:"state"`
+	Total         int      `json:"total"`
+	Found         int      `json:"found"`
+	LowConfidence int      `json:"low_confidence"`
+	NotFound      int      `json:"not_found"`
+	AddFailed     int      `json:"add_failed"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type PlaylistReport struct {
+	Playlist Playlist     `json:"playlist"`
+	Tracks   []TrackMatch `json:"tracks"`
+	// The transfer stopped before getting to the playlist, so none of its
+	// tracks were looked up
+	NotStarted bool `json:"not_started,omitempty"`
+}
+
+// A transfer copies a set of playlists from a Source to a Destination
+type transfer struct {
+	id      string
+	out     emitter
+	src     Source
+	dst     Destination
+	dryRun  bool
+	workers int
+	cache   *matchCache
+	journal *Journal
+
+	// Names the destination copy of each playlist, keeping its own name
+	// when nil
+	nameTemplate *template.Template
+
+	// Update the destination playlists previous transfers created instead
+	// of creating new ones, optionally removing tracks gone from the source
+	sync       bool
+	syncRemove bool
+	mappings   *playlistMappings
+
+	// Give the starred tracks a thumbs up instead of copying them to a
+	// playlist, optionally adding them to the library too
+	starredRatings bool
+	starredLibrary bool
+
+	// Closed when the transfer is cancelled
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+
+	mu            sync.Mutex
+	found         int
+	lowConfidence int
+	notFound      int
+	addFailed     int
+	report        []*PlaylistReport
+	err           error
+	playlists     []*PlaylistStatus
+	current       *PlaylistStatus
+
+	// While the transfer is paused, closed when it's unpaused
+	unpaused chan struct{}
+
+	// Progress of the playlist currently being matched
+	progress      ProgressType
+	progressStart time.Time
+}
+
+// A track waiting for a worker to match it
+type trackJob struct {
+	track BasicTrack
+	match *TrackMatch
+}
+
+func newTransfer(out emitter, src Source, dst Destination) *transfer {
+	return &transfer{
+		out:       out,
+		src:       src,
+		dst:       dst,
+		workers:   defaultSettings.Workers,
+		cancelled: make(chan struct{}),
+	}
+}
+
+// Stops the transfer. Searches and metadata waits in flight are abandoned,
+// and playlists that weren't finished are left for a resume.
+func (t *transfer) cancel() {
+	t.abort(errCancelled)
+	t.cancelOnce.Do(func() {
+		close(t.cancelled)
+	})
+}
+
+// Pauses the transfer before its next track. Tracks being matched finish,
+// and everything matched so far is kept. Returns false if it was already
+// paused.
+func (t *transfer) pause() bool {
+	t.mu.Lock()
+	if t.unpaused != nil {
+		t.mu.Unlock()
+		return false
+	}
+	t.unpaused = make(chan struct{})
+	t.mu.Unlock()
+
+	fmt.Printf("Transfer paused\n")
+	t.out.Emit("portify", &SocketIOResponse{"paused", nil})
+	return true
+}
+
+// Carries on with a paused transfer. Returns false if it wasn't paused.
+func (t *transfer) unpause() bool {
+	t.mu.Lock()
+	if t.unpaused == nil {
+		t.mu.Unlock()
+		return false
+	}
+	close(t.unpaused)
+	t.unpaused = nil
+	t.mu.Unlock()
+
+	fmt.Printf("Transfer resumed\n")
+	t.out.Emit("portify", &SocketIOResponse{"resumed", nil})
+	return true
+}
+
+func (t *transfer) isPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.unpaused != nil
+}
+
+// Blocks while the transfer is paused, unless it gets cancelled
+func (t *transfer) waitIfPaused() {
+	t.mu.Lock()
+	unpaused := t.unpaused
+	t.mu.Unlock()
+	if unpaused == nil {
+		return
+	}
+	select {
+	case <-unpaused:
+	case <-t.cancelled:
+	}
+}
+
+// Returns the state of every playlist of the transfer, and the progress of
+// the one being matched
+func (t *transfer) status() ([]PlaylistStatus, ProgressType) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	playlists := make([]PlaylistStatus, len(t.playlists))
+	for i, p := range t.playlists {
+		playlists[i] = *p
+	}
+	return playlists, t.progress
+}
+
+// Returns how many tracks were matched, how many of those matches are low
+// confidence and how many tracks couldn't be found so far
+func (t *transfer) counts() (found int, lowConfidence int, notFound int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.found, t.lowConfidence, t.notFound
+}
+
+// Returns how many matched tracks the destination refused to add
+func (t *transfer) addFailures() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.addFailed
+}
+
+// Returns the matches made for every playlist processed so far
+func (t *transfer) matchReport() []*PlaylistReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*PlaylistReport(nil), t.report...)
+}
+
+// Updates the report of a playlist after its matches were corrected
+func (t *transfer) replaceMatches(playlistUri string, tracks []TrackMatch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, report := range t.report {
+		if report.Playlist.Uri == playlistUri {
+			report.Tracks = append([]TrackMatch(nil), tracks...)
+		}
+	}
+}
+
+// Stops the transfer because of an error no further track can recover from.
+// Authentication errors ask the user to log in again.
+func (t *transfer) abort(err error) {
+	t.mu.Lock()
+	first := t.err == nil
+	if first {
+		t.err = err
+	}
+	t.mu.Unlock()
+
+	if authErr, ok := err.(*AuthError); ok && first {
+		t.out.Emit("portify", &SocketIOResponse{"auth_required", AuthRequiredType{authErr.Service}})
+	}
+}
+
+// Returns the error the transfer was aborted with, if any
+func (t *transfer) aborted() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *transfer) run(playlists []Playlist) {
+	// Convert to map to check for playlist
+	playlistMap := make(map[string]bool)
+	for _, playlist := range playlists {
+		playlistMap[playlist.Uri] = true
+	}
+
+	// Iterate over all source playlists (should be cached anyway)
+	srcPlaylists := t.src.AllPlaylists()
+	statuses := make(map[int]*PlaylistStatus)
+	t.mu.Lock()
+	for i, srcPlaylist := range srcPlaylists {
+		if _, ok := playlistMap[srcPlaylist.Uri]; ok {
+			statuses[i] = &PlaylistStatus{Playlist: srcPlaylist, State: playlistQueued}
+			t.playlists = append(t.playlists, statuses[i])
+		}
+	}
+	t.mu.Unlock()
+
+	for i, srcPlaylist := range srcPlaylists {
+		t.waitIfPaused()
+		if t.aborted() != nil {
+			break
+		}
+		if status, ok := statuses[i]; ok {
+			t.startPlaylist(i, srcPlaylist, status)
+		}
+	}
+
+	if err := t.aborted(); err != nil {
+		t.reportNotStarted()
+		fmt.Printf("Transfer aborted: %v\n", err)
+		if err == errCancelled {
+			t.out.Emit("portify", &SocketIOResponse{"cancelled", nil})
+		}
+		return
+	}
+	if t.journal != nil {
+		if err := t.journal.finish(); err != nil {
+			fmt.Printf("Couldn't checkpoint transfer: %v\n", err)
+		}
+	}
+	t.out.Emit("portify", &SocketIOResponse{"all_done", nil})
+	fmt.Printf("Complete\n")
+}
+
+// Adds the playlists a stopped transfer never got to to the report, so they
+// aren't taken for transferred ones
+func (t *transfer) reportNotStarted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, status := range t.playlists {
+		if status.State == playlistQueued {
+			t.report = append(t.report, &PlaylistReport{Playlist: status.Playlist, Tracks: []TrackMatch{}, NotStarted: true})
+		}
+	}
+}
+
+func (t *transfer) startPlaylist(i int, srcPlaylist Playlist, status *PlaylistStatus) {
+	var entry *JournalPlaylist
+	if t.journal != nil {
+		entry = t.journal.playlist(srcPlaylist)
+		if entry.Done {
+			fmt.Printf("Skipping '%s', it was already transferred\n", srcPlaylist.Name)
+			t.mu.Lock()
+			status.State = playlistSkipped
+			t.report = append(t.report, &PlaylistReport{Playlist: srcPlaylist, Tracks: entry.Matches})
+			t.mu.Unlock()
+			return
+		}
+	}
+
+	report := &PlaylistReport{Playlist: srcPlaylist, Tracks: []TrackMatch{}}
+	t.mu.Lock()
+	t.report = append(t.report, report)
+	status.State = playlistRunning
+	t.current = status
+	t.mu.Unlock()
+
+	t.out.Emit("portify", &SocketIOResponse{"playlist_started", PlaylistType{srcPlaylist, srcPlaylist.Name, i}})
+	err := t.createFullPlaylist(srcPlaylist, i, report, entry)
+	t.out.Emit("portify", &SocketIOResponse{"playlist_done", PlaylistType{srcPlaylist, srcPlaylist.Name, i}})
+
+	t.mu.Lock()
+	switch {
+	case err == errCancelled:
+		status.State = playlistCancelled
+	case err != nil:
+		status.State = playlistFailed
+		status.Error = err.Error()
+	default:
+		status.State = playlistDone
+	}
+	t.current = nil
+	t.mu.Unlock()
+	if err != nil {
+		fmt.Printf("Error creating playlist %s: %v", srcPlaylist.Name, err)
+	}
+}
+
+// Matches the tracks of a playlist and creates it in the destination. With a
+// journal entry, steps that were already checkpointed are not done again.
+func (t *transfer) createFullPlaylist(srcPlaylist Playlist, playlistNum int, report *PlaylistReport, entry *JournalPlaylist) error {
+	playlistName := srcPlaylist.Name
+	fmt.Printf("Processing playlist '%s'\n", playlistName)
+
+	var tracks []TrackMatch
+	if entry != nil && entry.Matched {
+		tracks = entry.Matches
+		fmt.Printf("Reusing %d matches from the journal\n", len(tracks))
+		t.out.Emit("portify", &SocketIOResponse{"playlist_length", PlaylistLengthType{len(tracks)}})
+		t.setPlaylistLength(len(tracks))
+		for _, match := range tracks {
+			t.recordMatch(match)
+		}
+	} else {
+		trackChan, count := t.src.PlaylistTracks(&srcPlaylist, t.cancelled)
+		t.out.Emit("portify", &SocketIOResponse{"playlist_length", PlaylistLengthType{count}})
+		t.setPlaylistLength(count)
+		var err error
+		tracks, err = t.matchPlaylist(trackChan, count, playlistNum)
+		if err != nil {
+			// Report how far matching got, tracks left unmatched included
+			t.mu.Lock()
+			report.Tracks = tracks
+			t.mu.Unlock()
+			return err
+		}
+		t.checkpoint(entry, func(entry *JournalPlaylist) {
+			entry.Matched = true
+			entry.Matches = tracks
+		})
+	}
+
+	t.mu.Lock()
+	report.Tracks = tracks
+	t.mu.Unlock()
+
+	if t.dryRun {
+		fmt.Printf("Dry run, not creating '%s'\n", playlistName)
+		return nil
+	}
+	t.waitIfPaused()
+	if err := t.aborted(); err != nil {
+		return err
+	}
+
+	if srcPlaylist.Uri == starredPlaylistUri && t.starredRatings {
+		return t.rateStarredTracks(tracks, entry)
+	}
+
+	songIds := []string{}
+	for _, match := range tracks {
+		if match.Found {
+			songIds = append(songIds, match.GoogleNid)
+		}
+	}
+
+	var playlistId string
+	created := false
+	if entry != nil && entry.DestinationId != "" {
+		playlistId = entry.DestinationId
+		fmt.Printf("'%s' was already created\n", playlistName)
+	} else if id, ok := t.syncedPlaylist(srcPlaylist); ok {
+		playlistId = id
+		fmt.Printf("Syncing '%s' into its existing copy\n", playlistName)
+		t.checkpoint(entry, func(entry *JournalPlaylist) {
+			entry.DestinationId = playlistId
+		})
+	} else {
+		destName, err := destinationName(t.nameTemplate, srcPlaylist)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Creating '%s'\n", destName)
+		playlistId, err = t.dst.CreatePlaylist(destName, false)
+		if isAuthError(err) {
+			t.abort(err)
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Error creating playlist: %v", err)
+		}
+		created = true
+		t.checkpoint(entry, func(entry *JournalPlaylist) {
+			entry.DestinationId = playlistId
+		})
+		if t.mappings != nil {
+			if err := t.mappings.Set(srcPlaylist.Uri, playlistId); err != nil {
+				fmt.Printf("Couldn't remember playlist mapping: %v\n", err)
+			}
+		}
+	}
+
+	if entry == nil || !entry.TracksAdded {
+		var err error
+		if t.sync && !created {
+			// Compares against what the playlist already has, so tracks
+			// added before an interruption aren't added again
+			err = t.syncTracks(playlistId, songIds)
+		} else {
+			err = t.addTracks(playlistId, songIds, tracks, entry)
+		}
+		if mutationErr, ok := err.(*MutationError); ok {
+			fmt.Printf("%d tracks couldn't be added to '%s'\n", len(mutationErr.Failures), playlistName)
+			t.recordAddFailures(tracks, mutationErr.Failures)
+		} else if isAuthError(err) {
+			t.abort(err)
+			return err
+		} else if err == errCancelled {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Error adding tracks to playlist: %v", err)
+		}
+	}
+	t.checkpoint(entry, func(entry *JournalPlaylist) {
+		entry.TracksAdded = true
+		entry.Done = true
+	})
+	return nil
+}
+
+// Appends tracks to a playlist, journaling how many were added after every
+// batch the destination sends so a resume carries on after them. Tracks the
+// destination rejects are recorded as they come.
+func (t *transfer) addTracks(playlistId string, songIds []string, tracks []TrackMatch, entry *JournalPlaylist) error {
+	start := 0
+	if entry != nil && entry.SongsAdded > 0 {
+		start = entry.SongsAdded
+		if start > len(songIds) {
+			start = len(songIds)
+		}
+		fmt.Printf("%d tracks were already added\n", start)
+	}
+	if start == len(songIds) {
+		return nil
+	}
+
+	err := t.dst.AddTracks(playlistId, songIds[start:], func(sent int, rejected []MutationFailure) error {
+		if len(rejected) > 0 {
+			fmt.Printf("%d tracks couldn't be added\n", len(rejected))
+			t.recordAddFailures(tracks, rejected)
+		}
+		t.checkpoint(entry, func(entry *JournalPlaylist) {
+			entry.SongsAdded = start + sent
+		})
+		return t.aborted()
+	})
+	if _, ok := err.(*MutationError); ok {
+		// Already recorded batch by batch
+		return nil
+	}
+	return err
+}
+
+// Makes sure the destination can rate tracks if asked to, before anything is
+// matched
+func checkStarredRatings(dst Destination, starredRatings bool) error {
+	if _, ok := dst.(RatingDestination); starredRatings && !ok {
+		return fmt.Errorf("Destination can't rate tracks")
+	}
+	return nil
+}
+
+// Gives the tracks found for the starred tracks a thumbs up, rather than
+// copying them to a playlist
+func (t *transfer) rateStarredTracks(tracks []TrackMatch, entry *JournalPlaylist) error {
+	dst, ok := t.dst.(RatingDestination)
+	if !ok {
+		return fmt.Errorf("Destination can't rate tracks")
+	}
+
+	if entry == nil || !entry.TracksAdded {
+		rated := []RelevantTrack{}
+		for _, match := range tracks {
+			if match.Found {
+				rated = append(rated, RelevantTrack{
+					Nid:    match.GoogleNid,
+					Artist: match.GoogleArtist,
+					Title:  match.GoogleTitle,
+					Album:  match.GoogleAlbum,
+				})
+			}
+		}
+		fmt.Printf("Giving %d starred tracks a thumbs up\n", len(rated))
+		err := dst.ThumbsUp(rated, t.starredLibrary)
+		if mutationErr, ok := err.(*MutationError); ok {
+			fmt.Printf("%d starred tracks couldn't be rated\n", len(mutationErr.Failures))
+			t.recordAddFailures(tracks, mutationErr.Failures)
+		} else if isAuthError(err) {
+			t.abort(err)
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Error rating starred tracks: %v", err)
+		}
+	}
+	t.checkpoint(entry, func(entry *JournalPlaylist) {
+		entry.TracksAdded = true
+		entry.Done = true
+	})
+	return nil
+}
+
+// Marks the matches whose tracks the destination refused to add
+func (t *transfer) recordAddFailures(tracks []TrackMatch, failures []MutationFailure) {
+	codes := make(map[string][]string)
+	for _, failure := range failures {
+		codes[failure.TrackId] = append(codes[failure.TrackId], failure.ResponseCode)
+	}
+
+	t.mu.Lock()
+	var failed []TrackMatch
+	for i := range tracks {
+		match := &tracks[i]
+		pending := codes[match.GoogleNid]
+		if !match.Found || match.Status == matchAddFailed || len(pending) == 0 {
+			continue
+		}
+		codes[match.GoogleNid] = pending[1:]
+		if match.Status == matchLowConfidence {
+			t.lowConfidence--
+		}
+		t.found--
+		t.addFailed++
+		if p := t.current; p != nil {
+			if match.Status == matchLowConfidence {
+				p.LowConfidence--
+			}
+			p.Found--
+			p.AddFailed++
+		}
+		match.Status = matchAddFailed
+		match.Error = fmt.Sprintf("Rejected by destination: %s", pending[0])
+		failed = append(failed, *match)
+	}
+	t.mu.Unlock()
+
+	for _, match := range failed {
+		t.out.Emit("gmusic", &SocketIOResponse{"add_failed",
+			AddedType{
+				Index:            match.Position,
+				Found:            true,
+				SpotifyTrackUri:  match.SpotifyTrackUri,
+				SpotifyTrackName: match.SpotifyTrackName,
+			},
+		},
+		)
+	}
+}
+
+// Returns the destination playlist a source playlist was previously copied
+// to, when syncing
+func (t *transfer) syncedPlaylist(srcPlaylist Playlist) (string, bool) {
+	if !t.sync || t.mappings == nil {
+		return "", false
+	}
+	return t.mappings.Get(srcPlaylist.Uri)
+}
+
+// Brings an existing destination playlist in line with the matched tracks:
+// tracks it doesn't have yet are appended, and with syncRemove tracks that
+// are no longer in the source are removed. Entries are compared by the
+// catalog id of their track; those without one, like uploads, can't have
+// been matched and are left alone.
+func (t *transfer) syncTracks(playlistId string, songIds []string) error {
+	syncDst, ok := t.dst.(SyncDestination)
+	if !ok {
+		return fmt.Errorf("Destination can't sync existing playlists")
+	}
+
+	entries, err := syncDst.PlaylistEntries(playlistId)
+	if err != nil {
+		return err
+	}
+
+	// Count tracks rather than just noting them, so a track that appears
+	// twice in the source also appears twice in the destination
+	existing := make(map[string]int)
+	for _, entry := range entries {
+		if entry.StoreId != "" {
+			existing[entry.StoreId]++
+		}
+	}
+	wanted := make(map[string]int)
+	newIds := []string{}
+	for _, songId := range songIds {
+		wanted[songId]++
+		if existing[songId] > 0 {
+			existing[songId]--
+		} else {
+			newIds = append(newIds, songId)
+		}
+	}
+
+	if len(newIds) > 0 {
+		fmt.Printf("Adding %d new tracks\n", len(newIds))
+		if err := t.dst.AddTracks(playlistId, newIds, nil); err != nil {
+			return err
+		}
+	}
+
+	if t.syncRemove {
+		staleIds := []string{}
+		for _, entry := range entries {
+			if entry.StoreId == "" {
+				continue
+			}
+			if wanted[entry.StoreId] > 0 {
+				wanted[entry.StoreId]--
+			} else {
+				staleIds = append(staleIds, entry.Id)
+			}
+		}
+		if len(staleIds) > 0 {
+			fmt.Printf("Removing %d tracks no longer in the source\n", len(staleIds))
+			if err := syncDst.RemoveEntries(staleIds); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Records how many tracks the playlist being transferred has
+func (t *transfer) setPlaylistLength(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.Total = count
+	}
+}
+
+// Records a step of a playlist in the journal, if the transfer keeps one
+func (t *transfer) checkpoint(entry *JournalPlaylist, change func(entry *JournalPlaylist)) {
+	if t.journal == nil || entry == nil {
+		return
+	}
+	if err := t.journal.update(entry, change); err != nil {
+		fmt.Printf("Couldn't checkpoint transfer: %v\n", err)
+	}
+}
+
+// Looks up every track coming from the source, returning the matches in the
+// order of the source playlist. When the transfer stops, the matches made so
+// far are returned along with the error, the others marked skipped.
+func (t *transfer) matchPlaylist(trackChan chan BasicTrack, trackCount int, playlistNum int) ([]TrackMatch, error) {
+	t.mu.Lock()
+	t.progress = ProgressType{Total: trackCount, Queued: trackCount}
+	t.progressStart = time.Now()
+	t.mu.Unlock()
+
+	// Tracks are matched by a fixed number of workers, but every result is
+	// written to the position the track had in the source playlist so the
+	// order survives.
+	jobs := make(chan trackJob)
+	var wg sync.WaitGroup
+	for w := 0; w < t.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				t.waitIfPaused()
+				if t.aborted() != nil {
+					job.match.SpotifyTrackUri = job.track.Uri
+					job.match.SpotifyTrackName = job.track.Name
+					job.match.Status = matchSkipped
+					continue
+				}
+				t.trackProgress(1)
+				prefix := fmt.Sprintf("(%d:%d/%d)", playlistNum, job.match.Position+1, trackCount)
+				t.matchTrack(prefix, job.track, job.match)
+				t.trackProgress(-1)
+			}
+		}()
+	}
+
+	var matches []*TrackMatch
+	for track := range trackChan {
+		match := &TrackMatch{Position: len(matches)}
+		matches = append(matches, match)
+		jobs <- trackJob{track, match}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Keep the matches made so far even when the transfer stops here
+	if t.cache != nil {
+		if err := t.cache.Save(); err != nil {
+			fmt.Printf("Couldn't save match cache: %v\n", err)
+		}
+	}
+
+	tracks := make([]TrackMatch, len(matches))
+	for i, match := range matches {
+		tracks[i] = *match
+	}
+	return tracks, t.aborted()
+}
+
+// Records a track starting (1) or finishing (-1) matching, and emits the
+// resulting progress of the playlist
+func (t *transfer) trackProgress(delta int) {
+	t.mu.Lock()
+	p := &t.progress
+	p.InFlight += delta
+	if delta > 0 {
+		p.Queued--
+	} else {
+		p.Done++
+	}
+	if elapsed := time.Since(t.progressStart).Seconds(); elapsed > 0 {
+		p.TracksPerSecond = float64(p.Done) / elapsed
+	}
+	progress := *p
+	t.mu.Unlock()
+
+	if delta < 0 {
+		t.out.Emit("portify", &SocketIOResponse{"progress", progress})
+	}
+}
+
+// Finds the best destination track, reusing the cached match if there is one
+func (t *transfer) findTrack(track BasicTrack) (*RelevantTrack, error) {
+	if t.cache != nil {
+		if m, ok := t.cache.Get(track.Uri); ok {
+			return &RelevantTrack{
+				Nid:        m.Nid,
+				Artist:     m.Artist,
+				Title:      m.Title,
+				Album:      m.Album,
+				Confidence: m.Confidence,
+				Karaoke:    m.Karaoke,
+			}, nil
+		}
+	}
+
+	bestTrack, err := t.dst.FindBestTrack(track, t.cancelled)
+	if err != nil {
+		return nil, err
+	}
+	if t.cache != nil {
+		t.cache.Put(track.Uri, CachedMatch{
+			Nid:        bestTrack.Nid,
+			Artist:     bestTrack.Artist,
+			Title:      bestTrack.Title,
+			Album:      bestTrack.Album,
+			Confidence: bestTrack.Confidence,
+			Matched:    time.Now(),
+			Karaoke:    bestTrack.Karaoke,
+		})
+	}
+	return bestTrack, nil
+}
+
+// Looks up a single track in the destination, filling in match
+func (t *transfer) matchTrack(prefix string, track BasicTrack, match *TrackMatch) {
+	match.SpotifyTrackUri = track.Uri
+	match.SpotifyTrackName = track.Name
+	match.SpotifyArtist = strings.Join(track.Artists, ", ")
+	match.SpotifyTitle = track.Title
+	match.SpotifyAlbum = track.Album
+
+	bestTrack, err := t.findTrack(track)
+	if isAuthError(err) {
+		// No point reporting every remaining track as missing
+		t.abort(err)
+		match.Status = matchSkipped
+		return
+	} else if err == errCancelled {
+		match.Status = matchSkipped
+		return
+	} else if err != nil {
+		fmt.Printf("%s: Couldn't find track: %s\n", prefix, err)
+		match.Status = matchNotFound
+		match.Error = err.Error()
+		_, match.Karaoke = err.(*KaraokeOnlyError)
+	} else {
+		fmt.Printf("%s: '%s' -> '%s - %s' (%.2f)\n", prefix, track.Name, bestTrack.Artist, bestTrack.Title, bestTrack.Confidence)
+		match.Found = true
+		match.Status = matchFound
+		match.Confidence = bestTrack.Confidence
+		match.GoogleNid = bestTrack.Nid
+		match.GoogleArtist = bestTrack.Artist
+		match.GoogleTitle = bestTrack.Title
+		match.GoogleAlbum = bestTrack.Album
+		match.Karaoke = bestTrack.Karaoke
+		if bestTrack.Confidence < lowMatchConfidence {
+			match.Status = matchLowConfidence
+		}
+	}
+	t.recordMatch(*match)
+}
+
+// Counts a match and tells the client about it
+func (t *transfer) recordMatch(match TrackMatch) {
+	t.mu.Lock()
+	p := t.current
+	if p == nil {
+		p = &PlaylistStatus{}
+	}
+	switch match.Status {
+	case matchFound:
+		t.found++
+		p.Found++
+	case matchLowConfidence:
+		t.found++
+		t.lowConfidence++
+		p.Found++
+		p.LowConfidence++
+	case matchNotFound:
+		t.notFound++
+		p.NotFound++
+	}
+	t.mu.Unlock()
+
+	if !match.Found {
+		t.out.Emit("gmusic", &SocketIOResponse{"not_added",
+			AddedType{
+				Index:            match.Position,
+				Found:            false,
+				SpotifyTrackUri:  match.SpotifyTrackUri,
+				SpotifyTrackName: match.SpotifyTrackName,
+				Karaoke:          match.Karaoke,
+			},
+		},
+		)
+		return
+	}
+
+	t.out.Emit("gmusic", &SocketIOResponse{"added",
+		AddedType{
+			Index:            match.Position,
+			Found:            true,
+			LowConfidence:    match.Status == matchLowConfidence,
+			Confidence:       match.Confidence,
+			SpotifyTrackUri:  match.SpotifyTrackUri,
+			SpotifyTrackName: match.SpotifyTrackName,
+			Karaoke:          match.Karaoke,
+		},
+	},
+	)
+}
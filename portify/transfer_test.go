@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Emits nothing
+type nopEmitter struct{}
+
+func (nopEmitter) Emit(event string, args ...interface{}) error { return nil }
+
+// A source serving fixed playlists. It sends every track even once
+// cancelled, which sources are allowed to do.
+type fakeSource struct {
+	playlists []Playlist
+	tracks    map[string][]BasicTrack
+}
+
+func (s *fakeSource) LoggedIn() bool           { return true }
+func (s *fakeSource) AllPlaylists() []Playlist { return s.playlists }
+
+func (s *fakeSource) PlaylistTracks(playlist *Playlist, cancel <-chan struct{}) (chan BasicTrack, int) {
+	tracks := s.tracks[playlist.Uri]
+	ret := make(chan BasicTrack)
+	go func() {
+		defer close(ret)
+		for _, track := range tracks {
+			ret <- track
+		}
+	}()
+	return ret, len(tracks)
+}
+
+// A destination finding every track under its URI, and keeping the
+// playlists created in memory
+type fakeDestination struct {
+	// Called instead of finding the track, if set
+	find func(track BasicTrack) (*RelevantTrack, error)
+
+	mu        sync.Mutex
+	playlists map[string][]PlaylistEntry
+	// The song ids of every AddTracks call
+	added   [][]string
+	removed []string
+	nextId  int
+}
+
+func newFakeDestination() *fakeDestination {
+	return &fakeDestination{playlists: make(map[string][]PlaylistEntry)}
+}
+
+func (d *fakeDestination) LoggedIn() bool { return true }
+
+func (d *fakeDestination) FindBestTrack(track BasicTrack, cancel <-chan struct{}) (*RelevantTrack, error) {
+	if d.find != nil {
+		return d.find(track)
+	}
+	return &RelevantTrack{Nid: track.Uri, Title: track.Title, Confidence: 1}, nil
+}
+
+func (d *fakeDestination) CreatePlaylist(name string, public bool) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextId++
+	id := fmt.Sprintf("playlist%d", d.nextId)
+	d.playlists[id] = []PlaylistEntry{}
+	return id, nil
+}
+
+func (d *fakeDestination) AddTracks(playlistId string, songIds []string, batchDone batchFunc) error {
+	d.mu.Lock()
+	d.added = append(d.added, songIds)
+	for _, songId := range songIds {
+		d.nextId++
+		d.playlists[playlistId] = append(d.playlists[playlistId], PlaylistEntry{
+			Id:         fmt.Sprintf("entry%d", d.nextId),
+			PlaylistId: playlistId,
+			TrackId:    songId,
+			StoreId:    songId,
+		})
+	}
+	d.mu.Unlock()
+	if batchDone != nil {
+		return batchDone(len(songIds), nil)
+	}
+	return nil
+}
+
+func (d *fakeDestination) PlaylistEntries(playlistId string) ([]PlaylistEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]PlaylistEntry(nil), d.playlists[playlistId]...), nil
+}
+
+func (d *fakeDestination) RemoveEntries(entryIds []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removed = append(d.removed, entryIds...)
+	removed := make(map[string]bool)
+	for _, id := range entryIds {
+		removed[id] = true
+	}
+	for playlistId, entries := range d.playlists {
+		kept := []PlaylistEntry{}
+		for _, entry := range entries {
+			if !removed[entry.Id] {
+				kept = append(kept, entry)
+			}
+		}
+		d.playlists[playlistId] = kept
+	}
+	return nil
+}
+
+func tracksOf(uris ...string) []BasicTrack {
+	tracks := []BasicTrack{}
+	for _, uri := range uris {
+		tracks = append(tracks, BasicTrack{Uri: uri, Name: uri, Title: uri})
+	}
+	return tracks
+}
+
+func TestCancelledTransferReport(t *testing.T) {
+	first := Playlist{Uri: "first", Name: "First"}
+	second := Playlist{Uri: "second", Name: "Second"}
+	src := &fakeSource{
+		playlists: []Playlist{first, second},
+		tracks: map[string][]BasicTrack{
+			"first":  tracksOf("a", "b", "c"),
+			"second": tracksOf("d"),
+		},
+	}
+	dst := newFakeDestination()
+	tr := newTransfer(nopEmitter{}, src, dst)
+	tr.workers = 1
+	dst.find = func(track BasicTrack) (*RelevantTrack, error) {
+		if track.Uri == "b" {
+			tr.cancel()
+			return nil, errCancelled
+		}
+		return &RelevantTrack{Nid: track.Uri, Confidence: 1}, nil
+	}
+	tr.run([]Playlist{first, second})
+
+	report := tr.matchReport()
+	if len(report) != 2 {
+		t.Fatalf("report has %d playlists, want 2", len(report))
+	}
+	statuses := []string{}
+	for _, match := range report[0].Tracks {
+		statuses = append(statuses, match.SpotifyTrackUri+":"+match.Status)
+	}
+	if want := []string{"a:found", "b:skipped", "c:skipped"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("first playlist reported %v, want %v", statuses, want)
+	}
+	if report[0].NotStarted {
+		t.Errorf("first playlist reported as not started")
+	}
+	if report[1].Playlist.Uri != "second" || !report[1].NotStarted {
+		t.Errorf("second playlist reported as %+v, want it not started", report[1])
+	}
+	if len(dst.playlists) != 0 {
+		t.Errorf("created %d playlists after cancelling", len(dst.playlists))
+	}
+
+	var buf bytes.Buffer
+	if err := writeReportCSV(&buf, unmatchedTracks(report)); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowStatuses := []string{}
+	for _, row := range rows[1:] {
+		rowStatuses = append(rowStatuses, strings.Join([]string{row[0], row[2], row[7]}, ":"))
+	}
+	want := []string{"First:2:skipped", "First:3:skipped", "Second::skipped"}
+	if !reflect.DeepEqual(rowStatuses, want) {
+		t.Errorf("CSV report rows %v, want %v", rowStatuses, want)
+	}
+}
+
+func TestSyncTracks(t *testing.T) {
+	dst := newFakeDestination()
+	dst.playlists["playlist"] = []PlaylistEntry{
+		// A catalog track the user added to their library
+		{Id: "kept", TrackId: "library-1", StoreId: "Tkept"},
+		// An upload, which can't have been matched
+		{Id: "upload", TrackId: "library-2"},
+		{Id: "stale", TrackId: "Tstale", StoreId: "Tstale"},
+		{Id: "twice", TrackId: "Ttwice", StoreId: "Ttwice"},
+	}
+	tr := newTransfer(nopEmitter{}, &fakeSource{}, dst)
+	tr.syncRemove = true
+
+	if err := tr.syncTracks("playlist", []string{"Tkept", "Ttwice", "Tnew", "Ttwice"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"Tnew", "Ttwice"}}; !reflect.DeepEqual(dst.added, want) {
+		t.Errorf("added %v, want %v", dst.added, want)
+	}
+	if want := []string{"stale"}; !reflect.DeepEqual(dst.removed, want) {
+		t.Errorf("removed %v, want %v", dst.removed, want)
+	}
+
+	// Syncing again changes nothing
+	dst.added, dst.removed = nil, nil
+	if err := tr.syncTracks("playlist", []string{"Tkept", "Ttwice", "Tnew", "Ttwice"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.added) != 0 || len(dst.removed) != 0 {
+		t.Errorf("second sync added %v and removed %v, want nothing changed", dst.added, dst.removed)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kinds of version a title qualifier can describe
+const (
+	versionLive     = "live"
+	versionAcoustic = "acoustic"
+	versionRemix    = "remix"
+	versionEdit     = "edit"
+	versionRemaster = "remaster"
+	versionExplicit = "explicit"
+	versionClean    = "clean"
+	// Qualifiers like "feat. Someone" that say nothing about the recording
+	versionNone = ""
+)
+
+// A rule recognising a qualifier, matched against its normalized text
+type versionRule struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+// The rules tried on every qualifier of a title, in order. The first that
+// matches decides its kind; qualifiers no rule matches stay part of the title.
+var versionRules = []versionRule{
+	{versionNone, regexp.MustCompile(`^(feat|ft|featuring|with) `)},
+	{versionNone, regexp.MustCompile(`\boriginal (mix|version)\b`)},
+	{versionLive, regexp.MustCompile(`\b(live|in concert)\b`)},
+	{versionAcoustic, regexp.MustCompile(`\b(acoustic|unplugged)\b`)},
+	{versionRemix, regexp.MustCompile(`\b(remix|remixed|rmx|mix|dub)\b`)},
+	{versionEdit, regexp.MustCompile(`\b(edit|radio version|single version)\b`)},
+	{versionRemaster, regexp.MustCompile(`\b(remaster|remastered|mono|stereo|\d{4} version|deluxe|anniversary)\b`)},
+	{versionExplicit, regexp.MustCompile(`\bexplicit\b`)},
+	{versionClean, regexp.MustCompile(`\b(clean|censored)\b`)},
+}
+
+// How much confidence a candidate keeps when it disagrees with the source
+// track on a kind of version. Remasters sound like the original, so they
+// don't count.
+var versionPenalties = map[string]float64{
+	versionLive:     0.6,
+	versionAcoustic: 0.7,
+	versionRemix:    0.6,
+	versionEdit:     0.9,
+	versionExplicit: 0.8,
+}
+
+// Kinds that only disagree with their opposite, whichever side has which: a
+// track that says neither explicit nor clean is fine either way
+var versionOpposites = map[string]string{
+	versionExplicit: versionClean,
+}
+
+// Text in brackets that qualifies a title
+var bracketQualifier = regexp.MustCompile(`\s*[\(\[]([^\(\)\[\]]*)[\)\]]`)
+
+// Splits the version qualifiers out of a title, returning the core title and
+// the kinds of version it is
+func parseTitle(title string) (string, map[string]bool) {
+	kinds := make(map[string]bool)
+	core := title
+
+	if p := strings.SplitN(core, " - ", 2); len(p) == 2 {
+		if kind, ok := versionKind(p[1]); ok {
+			core = p[0]
+			kinds[kind] = true
+		}
+	}
+	core = bracketQualifier.ReplaceAllStringFunc(core, func(m string) string {
+		inner := bracketQualifier.FindStringSubmatch(m)[1]
+		if kind, ok := versionKind(inner); ok {
+			kinds[kind] = true
+			return ""
+		}
+		return m
+	})
+
+	delete(kinds, versionNone)
+	core = strings.TrimSpace(core)
+	if core == "" {
+		// A title that is nothing but qualifiers is its own core
+		core = title
+	}
+	return core, kinds
+}
+
+// Adds the kinds of version the qualifiers of an album describe to those of
+// a track on it. A radio edit of an album doesn't make its tracks edits.
+func addAlbumVersions(versions map[string]bool, album string) {
+	_, albumVersions := parseTitle(album)
+	for kind := range albumVersions {
+		if kind != versionEdit {
+			versions[kind] = true
+		}
+	}
+}
+
+// Finds the kind of version a qualifier describes
+func versionKind(qualifier string) (string, bool) {
+	text := strings.Join(strings.Fields(normalize(qualifier)), " ")
+	for _, rule := range versionRules {
+		if rule.pattern.MatchString(text) {
+			return rule.kind, true
+		}
+	}
+	return "", false
+}
+
+// Returns how much confidence a candidate keeps given how its versions
+// agree with those of the source track, from 0 to 1
+func versionAgreement(source, candidate map[string]bool) float64 {
+	agreement := 1.0
+	for kind, penalty := range versionPenalties {
+		if source[kind] == candidate[kind] {
+			continue
+		}
+		if opposite, ok := versionOpposites[kind]; ok {
+			// Only a disagreement if the other side is the opposite
+			if !(source[kind] && candidate[opposite]) && !(candidate[kind] && source[opposite]) {
+				continue
+			}
+		}
+		agreement *= penalty
+	}
+	return agreement
+}
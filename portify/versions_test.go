@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Builds a set of version kinds
+func kinds(names ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+func TestParseTitle(t *testing.T) {
+	tests := []struct {
+		title    string
+		core     string
+		versions map[string]bool
+	}{
+		{"Song", "Song", kinds()},
+		{"Song - Remastered 2011", "Song", kinds(versionRemaster)},
+		{"Song - 2011 Remaster", "Song", kinds(versionRemaster)},
+		{"Song (Radio Edit)", "Song", kinds(versionEdit)},
+		{"Song [Single Version]", "Song", kinds(versionEdit)},
+		{"Song - Live at Wembley", "Song", kinds(versionLive)},
+		{"Song (Live) [Remastered]", "Song", kinds(versionLive, versionRemaster)},
+		{"Song (Acoustic Version)", "Song", kinds(versionAcoustic)},
+		{"Song (Dub Mix)", "Song", kinds(versionRemix)},
+		{"Song (feat. Someone)", "Song", kinds()},
+		{"Song [ft. Someone]", "Song", kinds()},
+		{"Song - Original Mix", "Song", kinds()},
+		{"Song (Explicit)", "Song", kinds(versionExplicit)},
+		{"Song (Clean)", "Song", kinds(versionClean)},
+		// Qualifiers that aren't a version stay part of the title
+		{"Song (Part 2)", "Song (Part 2)", kinds()},
+		{"Song - Side A", "Song - Side A", kinds()},
+		// A title that is nothing but qualifiers is its own core
+		{"(Live)", "(Live)", kinds(versionLive)},
+		{"[Remastered]", "[Remastered]", kinds(versionRemaster)},
+	}
+	for _, test := range tests {
+		core, versions := parseTitle(test.title)
+		if core != test.core || !reflect.DeepEqual(versions, test.versions) {
+			t.Errorf("parseTitle(%q) = %q, %v, want %q, %v", test.title, core, versions, test.core, test.versions)
+		}
+	}
+}
+
+func TestVersionKind(t *testing.T) {
+	tests := []struct {
+		qualifier string
+		kind      string
+		ok        bool
+	}{
+		{"Live", versionLive, true},
+		{"Live at Wembley", versionLive, true},
+		{"In Concert", versionLive, true},
+		{"Unplugged", versionAcoustic, true},
+		{"Extended Remix", versionRemix, true},
+		{"Radio Edit", versionEdit, true},
+		{"Radio Version", versionEdit, true},
+		{"Remastered 2011", versionRemaster, true},
+		{"2009 Version", versionRemaster, true},
+		{"Mono", versionRemaster, true},
+		{"feat. Someone", versionNone, true},
+		{"Featuring Someone", versionNone, true},
+		{"with Someone", versionNone, true},
+		{"Original Version", versionNone, true},
+		{"Explicit", versionExplicit, true},
+		{"Censored", versionClean, true},
+		{"Part 2", "", false},
+		// "live" only counts as a whole word
+		{"Deliverance", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		kind, ok := versionKind(test.qualifier)
+		if kind != test.kind || ok != test.ok {
+			t.Errorf("versionKind(%q) = %q, %v, want %q, %v", test.qualifier, kind, ok, test.kind, test.ok)
+		}
+	}
+}
+
+func TestVersionAgreement(t *testing.T) {
+	tests := []struct {
+		name              string
+		source, candidate map[string]bool
+		want              float64
+	}{
+		{"same", kinds(versionLive), kinds(versionLive), 1},
+		{"neither", kinds(), kinds(), 1},
+		{"live against studio", kinds(versionLive), kinds(), 0.6},
+		{"studio against live", kinds(), kinds(versionLive), 0.6},
+		{"remasters don't count", kinds(versionRemaster), kinds(), 1},
+		{"edit", kinds(versionEdit), kinds(), 0.9},
+		{"several", kinds(versionLive, versionAcoustic), kinds(), 0.6 * 0.7},
+		{"explicit against clean", kinds(versionExplicit), kinds(versionClean), 0.8},
+		{"clean against explicit", kinds(versionClean), kinds(versionExplicit), 0.8},
+		{"explicit against unmarked", kinds(versionExplicit), kinds(), 1},
+		{"unmarked against clean", kinds(), kinds(versionClean), 1},
+	}
+	for _, test := range tests {
+		if got := versionAgreement(test.source, test.candidate); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: versionAgreement = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAlbumVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		track     BasicTrack
+		candidate MatchCandidate
+		want      float64
+	}{
+		{
+			name:      "live album on both sides",
+			track:     BasicTrack{Title: "Song", Artists: []string{"Band"}, Album: "Wembley (Live)", Duration: 200 * time.Second},
+			candidate: MatchCandidate{Title: "Song", Artist: "Band", Album: "Wembley (Live)", Duration: 200 * time.Second},
+			want:      1,
+		},
+		{
+			name:      "live track against live album",
+			track:     BasicTrack{Title: "Song - Live", Artists: []string{"Band"}},
+			candidate: MatchCandidate{Title: "Song", Artist: "Band", Album: "Wembley (Live)"},
+			want:      1,
+		},
+		{
+			name:      "studio track against live album",
+			track:     BasicTrack{Title: "Song", Artists: []string{"Band"}},
+			candidate: MatchCandidate{Title: "Song", Artist: "Band", Album: "Wembley (Live)"},
+			want:      0.6,
+		},
+		{
+			name:      "edits of albums don't count",
+			track:     BasicTrack{Title: "Song", Artists: []string{"Band"}},
+			candidate: MatchCandidate{Title: "Song", Artist: "Band", Album: "Album (Radio Edit)"},
+			want:      1,
+		},
+	}
+	for _, test := range tests {
+		_, versions := candidateVersions(test.candidate)
+		if got := versionAgreement(newTrackQuery(test.track).Versions, versions); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: versionAgreement = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 
 angular.module('portify', []).
-  factory('portifyService', function($rootScope, $http, $q, $location) {
+  factory('portifyService', function($rootScope, $http, $q, $location, socket) {
 	var portifyService = {};
 
 	//Gets the list of nuclear weapons
@@ -19,18 +19,81 @@ angular.module('portify', []).
 		return deferred.promise;
 	};
 
-	portifyService.startTransfer = function(lists) {
+	// Gets the playlists arranged in their folders
+	portifyService.getSpotifyPlaylistTree = function() {
+		var deferred = $q.defer();
+		$http.get('/spotify/playlists?tree=1')
+			.success(function(data) {
+				if(data.status == 402)
+					$location.path( "/spotify/login" );
+				deferred.resolve(data.data);
+			})
+			.error(function(error){
+				deferred.reject();
+				alert(error);
+			});
+
+		return deferred.promise;
+	};
+
+	// Gets the playlist files uploaded before
+	portifyService.getPlaylistFiles = function() {
+		var deferred = $q.defer();
+		$http.get('/portify/files')
+			.success(function(data) {
+				deferred.resolve(data.data);
+			})
+			.error(function(error){
+				deferred.reject();
+				alert(error);
+			});
+
+		return deferred.promise;
+	};
+
+	// Uploads M3U, XSPF or CSV playlist files
+	portifyService.uploadPlaylistFiles = function(files) {
+		var deferred = $q.defer();
+		var form = new FormData();
+		for ( var i = 0; i < files.length; i++) {
+			form.append("files", files[i]);
+		}
+		$.ajax({url: "/portify/files", type: "POST", data: form, dataType: "json", processData: false, contentType: false})
+			.done(function(data) {
+				$rootScope.$apply(function() {
+					if(data.status == 200) {
+						deferred.resolve(data.data);
+					} else {
+						alert(data.message);
+						deferred.reject();
+					}
+				});
+			})
+			.fail(function(xhr, status, error) {
+				$rootScope.$apply(function() {
+					alert(error);
+					deferred.reject();
+				});
+			});
+
+		return deferred.promise;
+	};
+
+	portifyService.startTransfer = function(lists, options) {
+		options = options || {};
 		$http({
 			url: "/portify/transfer/start",
 			dataType: "json",
 			method: "POST",
-			data: lists,
+			data: {source: options.source || "spotify", destination: "google", playlists: lists, sync: !!options.sync, sync_remove: !!options.syncRemove, starred_ratings: !!options.starredRatings, starred_library: !!options.starredLibrary},
 			headers: {
 				"Content-Type": "application/json; charset=utf-8"
 			}
 		}).success(function(response){
 				if(response.status == 200) {
 					console.log("initated transfer...");
+					$rootScope.transferId = response.data.id;
+					socket.subscribe(response.data.id);
 				} else {
 					if(response.status == 401)
 						$location.path( "/google/login" );
@@ -47,6 +110,16 @@ angular.module('portify', []).
 			});
 	};
 
+	portifyService.cancelTransfer = function(id) {
+		$http.post('/portify/transfer/' + id + '/cancel')
+			.success(function(response) {
+				if(response.status != 200)
+					console.log(response.message);
+			}).error(function(error){
+				console.log(error);
+			});
+	};
+
 	return portifyService;
   }).
 	factory('context', function($rootScope, $http, $q) {
@@ -71,14 +144,57 @@ angular.module('portify', []).
 	}).
 	factory('socket', function ($rootScope) {
 		var socket = io()
+		// The job whose events we get, and the last of its events we saw
+		var job = null;
+		var lastSeq = 0;
+
+		socket.on('connect', function () {
+			// Rejoin the job after reconnecting, catching up on missed events
+			if(job) {
+				socket.emit('subscribe', {id: job, since: lastSeq});
+			}
+		});
+
+		// The handlers of every event. Each event is listened to once, so
+		// replayed events are dropped once rather than by every handler.
+		var handlers = {};
+
 		return {
-			on: function (eventName, callback) {
-				socket.on(eventName, function () {
-					var args = arguments;
-					$rootScope.$apply(function () {
-						callback.apply(socket, args);
+			// Handlers given a scope are removed when it's destroyed
+			on: function (eventName, callback, scope) {
+				if(!handlers[eventName]) {
+					handlers[eventName] = [];
+					socket.on(eventName, function (data) {
+						var args = arguments;
+						if(data && data.seq) {
+							if(data.seq <= lastSeq)
+								return;
+							lastSeq = data.seq;
+						}
+						var callbacks = handlers[eventName].slice();
+						$rootScope.$apply(function () {
+							for ( var i = 0; i < callbacks.length; i++) {
+								callbacks[i].apply(socket, args);
+							}
+						});
 					});
-				});
+				}
+				handlers[eventName].push(callback);
+				if(scope) {
+					scope.$on('$destroy', function() {
+						var i = handlers[eventName].indexOf(callback);
+						if(i >= 0)
+							handlers[eventName].splice(i, 1);
+					});
+				}
+			},
+			subscribe: function (id) {
+				if(job) {
+					socket.emit('unsubscribe', job);
+				}
+				job = id;
+				lastSeq = 0;
+				socket.emit('subscribe', {id: job, since: 0});
 			},
 			emit: function (eventName, data, callback) {
 				socket.emit(eventName, data, function () {
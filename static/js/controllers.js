@@ -21,19 +21,26 @@ function ProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $routeP
 
 	$scope.notfound = [];
 	$scope.shownotfound = false;
+	$scope.transferId = null;
+	$rootScope.$watch('transferId', function(id) {
+		$scope.transferId = id;
+	});
 
 	$scope.currentPlaylist = {
 		name: "",
 		processed: 0,
 		found: 0,
 		notfound: 0,
+		lowconfidence: 0,
 		karaoke: 0,
 		count: 0,
+		queued: 0,
+		throughput: 0,
 		progress: 0,
 	};
 
 	$timeout(function() {
-		portifyService.startTransfer($scope.playlists);
+		portifyService.startTransfer($scope.playlists, $rootScope.transferOptions);
 	}, 600);
 
 	$scope.hideMissing = function() {
@@ -44,6 +51,21 @@ function ProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $routeP
 		$scope.shownotfound = true;
 	};
 
+	$scope.cancelTransfer = function() {
+		if($rootScope.transferId)
+			portifyService.cancelTransfer($rootScope.transferId);
+	};
+
+	$scope.pauseTransfer = function() {
+		if($rootScope.transferId)
+			socket.emit('pause', $rootScope.transferId);
+	};
+
+	$scope.resumeTransfer = function() {
+		if($rootScope.transferId)
+			socket.emit('resume', $rootScope.transferId);
+	};
+
 	socket.on('portify', function (data) {
 		if(data.type == "playlist_started") {
 			$scope.cover = null;
@@ -55,24 +77,44 @@ function ProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $routeP
 				processed: 0,
 				found: 0,
 				notfound: 0,
+				lowconfidence: 0,
 				karaoke: 0,
 				count: 0,
+				queued: 0,
+				throughput: 0,
 				progress: 0
 			};
 			$scope.processing = true;
 		} else if(data.type == "all_done") {
 			$scope.alldone = true;
+		} else if(data.type == "paused") {
+			$scope.paused = true;
+		} else if(data.type == "resumed") {
+			$scope.paused = false;
+		} else if(data.type == "cancelled") {
+			$scope.processing = false;
+			$scope.cancelled = true;
+			$scope.status = "Transfer cancelled.";
+		} else if(data.type == "auth_required") {
+			alert(data.data.service + " login expired, please log in again.");
+			$location.path( "/google/login" );
 		} else if(data.type == "playlist_done") {
 			$scope.processing = false;
-		} else if(data.type = "playlist_length") {
+		} else if(data.type == "playlist_length") {
 			$scope.currentPlaylist.count = data.data.length;
+		} else if(data.type == "progress") {
+			$scope.currentPlaylist.queued = data.data.queued;
+			$scope.currentPlaylist.throughput = data.data.tracks_per_second.toFixed(1);
 		}
-	});
+	}, $scope);
 
 	socket.on('gmusic', function (data) {
 		if(data.type == "added") {
 			$scope.currentPlaylist.processed++;
 			$scope.currentPlaylist.found++;
+			if(data.data.low_confidence) {
+				$scope.currentPlaylist.lowconfidence++;
+			}
 		} else if(data.type == "not_added") {
 			$scope.notfound.push(data.data.spotify_track_name);
 			$scope.currentPlaylist.processed++;
@@ -80,12 +122,16 @@ function ProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $routeP
 			if(data.data.karaoke) {
 				$scope.currentPlaylist.karaoke++;
 			}
+		} else if(data.type == "add_failed") {
+			$scope.notfound.push(data.data.spotify_track_name);
+			$scope.currentPlaylist.found--;
+			$scope.currentPlaylist.notfound++;
 		}
 		if($scope.currentPlaylist.count == 0)
 			$scope.currentPlaylist.progress = "0%";
 		else
 			$scope.currentPlaylist.progress = (($scope.currentPlaylist.processed / $scope.currentPlaylist.count)*100) +"%";
-	});
+	}, $scope);
 }
 
 function FancyProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $routeParams, $location, socket, context, portifyService, $timeout, $anchorScroll) {
@@ -116,7 +162,7 @@ function FancyProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $r
 		} else if(data.type == "all_done") {
 			$scope.alldone = true;
 		}
-	});
+	}, $scope);
 
 	socket.on('gmusic', function (data) {
 		var myidx = findIndexByKeyValue($scope.tracks, "id", data.data.spotify_track_uri );
@@ -132,7 +178,7 @@ function FancyProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $r
 		} else if(data.type == "added") {
 			$scope.tracks[myidx].ok = true;
 		}
-	});
+	}, $scope);
 
 	socket.on('spotify', function (data) {
 		if(data.type == "track") {
@@ -143,12 +189,41 @@ function FancyProcessTransferCtrl($scope, $rootScope, $filter, $http, $route, $r
 				$scope.ttracks = $filter('limitTo')($scope.tracks,-60);
 			}
 		}
-	});
+	}, $scope);
 }
 
-function GoogleLoginCtrl($scope, $rootScope, $http, $location) {
+function GoogleLoginCtrl($scope, $rootScope, $http, $location, $timeout) {
 	$rootScope.step = 1;
 	$rootScope.link = '';
+	$scope.device = null;
+
+	// Skip the login when one was kept from an earlier run, and wait for
+	// device logins to finish
+	var checkStatus = function() {
+		$http.get('/google/login/status').success(function(response) {
+			var status = response.data;
+			if(status.logged_in) {
+				$location.path( "/spotify/login" );
+			} else if(status.device && status.device.pending) {
+				$timeout(checkStatus, status.device.code.interval * 1000);
+			} else if(status.device && status.device.error) {
+				$scope.device = null;
+				alert(status.device.error);
+			}
+		});
+	};
+	checkStatus();
+
+	$scope.deviceLogin = function() {
+		$http.post('/google/login/device').success(function(response) {
+			if(response.status == 200) {
+				$scope.device = response.data;
+				$timeout(checkStatus, response.data.interval * 1000);
+			} else {
+				alert(response.message);
+			}
+		});
+	};
 	$scope.googleLogin = function() {
 		$http({
 			url: "/google/login",
@@ -195,25 +270,94 @@ function SpotifyLoginCtrl($scope, $rootScope, $http, $location) {
 }
 
 function SelectSpotifyCtrl($scope, $rootScope, $http, $location, portifyService, context) {
-	$scope.playlists = portifyService.getSpotifyPlaylists();
+	// Folders and playlists as table rows, folders followed by what's in them
+	$scope.rows = [];
+	$scope.playlists = [];
+	$rootScope.transferOptions = $rootScope.transferOptions || {sync: false, syncRemove: false, starredRatings: false, starredLibrary: false};
+	$scope.options = $rootScope.transferOptions;
 	$rootScope.step = 3;
 	$rootScope.link = '';
+
+	// Adds the rows of a folder, returning every playlist in it
+	var addFolder = function(folder, depth) {
+		var playlists = [];
+		for ( var i = 0; i < folder.folders.length; i++) {
+			var row = {folder: true, name: folder.folders[i].name, depth: depth, transfer: false};
+			$scope.rows.push(row);
+			row.playlists = addFolder(folder.folders[i], depth + 1);
+			playlists = playlists.concat(row.playlists);
+		}
+		for ( var i = 0; i < folder.playlists.length; i++) {
+			var playlist = folder.playlists[i];
+			$scope.rows.push({folder: false, name: playlist.name, depth: depth, playlist: playlist});
+			$scope.playlists.push(playlist);
+			playlists.push(playlist);
+		}
+		return playlists;
+	};
+
+	// Uploaded playlist files are shown in a folder of their own
+	var files = {folder: true, name: "Playlist files", depth: 0, transfer: false, playlists: []};
+	var addFiles = function(playlists) {
+		if(files.playlists.length == 0 && playlists.length > 0)
+			$scope.rows.push(files);
+		for ( var i = 0; i < playlists.length; i++) {
+			$scope.rows.push({folder: false, name: playlists[i].name, depth: 1, playlist: playlists[i]});
+			$scope.playlists.push(playlists[i]);
+			files.playlists.push(playlists[i]);
+		}
+	};
+
+	portifyService.getSpotifyPlaylistTree().then(function(tree) {
+		addFolder(tree, 0);
+		return portifyService.getPlaylistFiles();
+	}).then(addFiles);
+
+	$scope.uploadFiles = function(input) {
+		portifyService.uploadPlaylistFiles(input.files).then(addFiles);
+		input.value = "";
+	};
+
+	var isFile = function(playlist) {
+		return playlist.uri.indexOf("file:") == 0;
+	};
+
+	$scope.selectFolder = function(row) {
+		for ( var i = 0; i < row.playlists.length; i++) {
+			row.playlists[i].transfer = row.transfer;
+		}
+	};
+
 	$scope.selectAll = function ($event){
 		var checkbox = $event.target;
-		for ( var i = 0; i < $scope.playlists.$$v.length; i++) {
-			$scope.playlists.$$v[i].transfer = checkbox.checked;
+		for ( var i = 0; i < $scope.rows.length; i++) {
+			$scope.rows[i].transfer = checkbox.checked;
+		}
+		for ( var i = 0; i < $scope.playlists.length; i++) {
+			$scope.playlists[i].transfer = checkbox.checked;
 		}
 	};
 
 	$scope.startTransfer = function() {
 		context.clear();
-		for ( var i = 0; i < $scope.playlists.$$v.length; i++) {
-			if($scope.playlists.$$v[i].transfer) {
-				context.addItem($scope.playlists.$$v[i]);
+		for ( var i = 0; i < $scope.playlists.length; i++) {
+			if($scope.playlists[i].transfer) {
+				context.addItem($scope.playlists[i]);
+			}
+		}
+
+		// A transfer reads from either Spotify or playlist files
+		var items = context.items();
+		var fromFiles = items.length > 0 && isFile(items[0]);
+		for ( var i = 0; i < items.length; i++) {
+			if(isFile(items[i]) != fromFiles) {
+				alert("Please transfer playlist files separately from Spotify playlists");
+				return;
 			}
 		}
+		$scope.options.source = fromFiles ? "file" : "spotify";
 
-		if(context.items().length == 0)
+		if(items.length == 0)
 			alert("Please select at least one playlist");
 		else
 			$location.path( "/transfer/process" );